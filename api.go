@@ -0,0 +1,300 @@
+package tenpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIList is the body of the list responses of MakeAPI.
+type APIList struct {
+	Attachments []*Attachment
+	// Count is the number of attachments of the owners, for lists by owner.
+	Count int `json:",omitempty"`
+	// NextCursor is the cursor parameter of the next page, for the lists
+	// of a Querier.
+	NextCursor string `json:",omitempty"`
+}
+
+// APIError is the body of the error responses of MakeAPI.
+type APIError struct {
+	Error string
+}
+
+// AttachmentPatch has the fields of an attachment that can be edited with
+// PATCH, the ones left nil are kept.
+type AttachmentPatch struct {
+	Filename *string
+	Category *string
+	GroupId  *[]string
+	// Attrs and Tags replace all the attributes or tags.
+	Attrs *map[string]string
+	Tags  *[]string
+}
+
+// MakeAPI serves attachment meta as JSON under basePath:
+//
+//	GET    basePath/{id}            the attachment
+//	GET    basePath?id=a&id=b       the attachments of the ids
+//	GET    basePath?owner=a&owner=b the attachments of the owners, and their count
+//	GET    basePath?group=g         the attachments of the group
+//
+// When the MetaStorage is a Querier, the lists by owner and group are pages
+// of a Query, narrowed and ordered by the parameters:
+//
+//	category=c              of the category
+//	type=image/             of the content types with the prefix
+//	after=t&before=t        uploaded in the RFC 3339 time range
+//	minsize=n&maxsize=n     of the size range in bytes
+//	sort=time|name|size     the order, time by default
+//	order=asc|desc          ascending by default
+//	limit=n                 the page size
+//	cursor=c                the NextCursor of the previous page
+//	tag=t&tag=u             labelled with all the tags
+//	attr.name=v             with the attribute name set to v
+//
+// The remaining API is:
+//
+//	PATCH  basePath/{id}            edits it with an AttachmentPatch body
+//	DELETE basePath/{id}            moves it to the trash
+//
+// Errors are an APIError with the status of StatusCode. Every attachment
+// is checked with the Authorizer of maker, if it has one, the lists leave
+// out the ones it denies.
+func MakeAPI(maker StorageMaker, basePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blob, meta, input, err := maker.MakeForRead(r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		cmeta := MetaContext(meta)
+		ctx := r.Context()
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, basePath), "/")
+
+		if id == "" {
+			if r.Method != "GET" {
+				writeAPIStatus(w, http.StatusMethodNotAllowed, &APIError{"method not allowed"})
+				return
+			}
+
+			query := r.URL.Query()
+			list := &APIList{}
+			querier, isQuerier := meta.(Querier)
+			switch {
+			case len(query["id"]) > 0:
+				list.Attachments, err = cmeta.AttachmentByIdsContext(ctx, query["id"])
+			case isQuerier && (len(query["owner"]) > 0 || query.Get("group") != ""):
+				var q *Query
+				var page *Page
+				if q, err = parseQuery(query); err != nil {
+					break
+				}
+				if page, err = querier.QueryAttachments(q); err != nil {
+					break
+				}
+				list.Attachments, list.NextCursor = page.Attachments, page.NextCursor
+				if len(q.OwnerIds) > 0 {
+					list.Count, err = cmeta.AttachmentsCountByOwnerIdsContext(ctx, q.OwnerIds)
+				}
+			case len(query["owner"]) > 0:
+				list.Attachments, err = cmeta.AttachmentsByOwnerIdsContext(ctx, query["owner"])
+				if err == nil {
+					list.Count, err = cmeta.AttachmentsCountByOwnerIdsContext(ctx, query["owner"])
+				}
+			case query.Get("group") != "":
+				list.Attachments, err = cmeta.AttachmentsByGroupIdContext(ctx, query.Get("group"))
+			default:
+				err = fmt.Errorf("%w: id, owner or group required", ErrInvalid)
+			}
+			if err == nil {
+				list.Attachments, err = Authorized(maker, r, ActionRead, list.Attachments)
+			}
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+
+			if list.Attachments == nil {
+				list.Attachments = []*Attachment{}
+			}
+			writeAPIStatus(w, http.StatusOK, list)
+			return
+		}
+
+		att, err := liveAttachment(ctx, cmeta, id)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			if err = Authorize(maker, r, ActionRead, att); err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			writeAPIStatus(w, http.StatusOK, att)
+
+		case "PATCH":
+			if err = Authorize(maker, r, ActionUpload, att); err != nil {
+				writeAPIError(w, err)
+				return
+			}
+
+			var patch AttachmentPatch
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err = dec.Decode(&patch); err != nil {
+				writeAPIError(w, fmt.Errorf("%w: %v", ErrInvalid, err))
+				return
+			}
+			// the patch is applied to the attachment as it is when stored,
+			// not as it was read above, see updateAttachment
+			att, err = updateAttachment(ctx, meta, id, func(att *Attachment) (err error) {
+				if att.Trashed() {
+					err = fmt.Errorf("%w: attachment id %s", ErrNotFound, id)
+					return
+				}
+				if err = Authorize(maker, r, ActionUpload, att); err != nil {
+					return
+				}
+				err = patch.Apply(att)
+				return
+			})
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			writeAPIStatus(w, http.StatusOK, att)
+
+		case "DELETE":
+			if err = Authorize(maker, r, ActionDelete, att); err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			att, _, err = DeleteAttachmentContext(ctx, &idInput{input, id}, blob, meta)
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			writeAPIStatus(w, http.StatusOK, att)
+
+		default:
+			writeAPIStatus(w, http.StatusMethodNotAllowed, &APIError{"method not allowed"})
+		}
+	}
+}
+
+// Apply sets the fields of p on att.
+func (p *AttachmentPatch) Apply(att *Attachment) (err error) {
+	if p.Filename != nil {
+		if strings.TrimSpace(*p.Filename) == "" || strings.ContainsAny(*p.Filename, "/\\") {
+			err = fmt.Errorf("%w: filename %q", ErrInvalid, *p.Filename)
+			return
+		}
+		att.Filename = *p.Filename
+	}
+	if p.Category != nil {
+		att.Category = *p.Category
+	}
+	if p.GroupId != nil {
+		att.GroupId = *p.GroupId
+	}
+	if p.Attrs != nil {
+		if err = ValidateAttrs(*p.Attrs); err != nil {
+			return
+		}
+		att.Attrs = *p.Attrs
+	}
+	if p.Tags != nil {
+		att.Tags = CleanTags(*p.Tags)
+	}
+	return
+}
+
+// parseQuery reads the Query of the list parameters of MakeAPI.
+func parseQuery(values url.Values) (q *Query, err error) {
+	q = &Query{
+		OwnerIds:          values["owner"],
+		GroupId:           values.Get("group"),
+		Category:          values.Get("category"),
+		ContentTypePrefix: values.Get("type"),
+		Sort:              Sort(values.Get("sort")),
+		Cursor:            values.Get("cursor"),
+		Tags:              values["tag"],
+	}
+	for name, v := range values {
+		if strings.HasPrefix(name, "attr.") {
+			if q.Attrs == nil {
+				q.Attrs = map[string]string{}
+			}
+			q.Attrs[strings.TrimPrefix(name, "attr.")] = v[0]
+		}
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		err = fmt.Errorf("%w: order %q", ErrInvalid, values.Get("order"))
+		return
+	}
+
+	for name, t := range map[string]*time.Time{"after": &q.UploadedAfter, "before": &q.UploadedBefore} {
+		if v := values.Get(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				err = fmt.Errorf("%w: %s: %v", ErrInvalid, name, err)
+				return
+			}
+		}
+	}
+	for name, n := range map[string]*int64{"minsize": &q.MinSize, "maxsize": &q.MaxSize} {
+		if v := values.Get(name); v != "" {
+			if *n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				err = fmt.Errorf("%w: %s: %v", ErrInvalid, name, err)
+				return
+			}
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			err = fmt.Errorf("%w: limit: %v", ErrInvalid, err)
+			return
+		}
+	}
+	return
+}
+
+// idInput is an Input for the attachment id of the URL path.
+type idInput struct {
+	Input
+	id string
+}
+
+func (i *idInput) GetViewMeta() (id string, thumb string, download bool) {
+	id = i.id
+	return
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := StatusCode(err)
+	if status >= http.StatusInternalServerError {
+		log.Printf("tenpu: api error: %v\n", err)
+	}
+	writeAPIStatus(w, status, &APIError{err.Error()})
+}
+
+func writeAPIStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	b, _ := json.Marshal(v)
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,43 @@
+package tenpu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateAttrs checks the names of attrs can be stored and queried by
+// every MetaStorage: they must not be empty, hold a "." or start with "$".
+func ValidateAttrs(attrs map[string]string) (err error) {
+	for name := range attrs {
+		if name == "" || strings.Contains(name, ".") || strings.HasPrefix(name, "$") {
+			err = fmt.Errorf("%w: attribute name %q", ErrInvalid, name)
+			return
+		}
+	}
+	return
+}
+
+// CleanTags trims the space around tags, and drops the empty and repeated
+// ones.
+func CleanTags(tags []string) (r []string) {
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		r = append(r, tag)
+	}
+	return
+}
+
+// HasTag tells if att is labelled with tag.
+func (att *Attachment) HasTag(tag string) bool {
+	for _, t := range att.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package tenpu
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Action is what a request does with an attachment.
+type Action int
+
+const (
+	// ActionRead is viewing an attachment, its thumbnails or its revisions.
+	ActionRead Action = iota
+	// ActionDownload is loading an attachment with the download flag, or
+	// in a zip.
+	ActionDownload
+	// ActionDelete is moving an attachment to the trash, or restoring it.
+	ActionDelete
+	// ActionUpload is creating an attachment, or changing it: its body with
+	// a new revision or a revert, or its meta.
+	ActionUpload
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionRead:
+		return "read"
+	case ActionDownload:
+		return "download"
+	case ActionDelete:
+		return "delete"
+	case ActionUpload:
+		return "upload"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// Authorizer is implemented by StorageMakers that decide per attachment
+// what a request may do. The handlers ask it with the attachment they
+// resolved, before doing anything with it. For ActionUpload of a new
+// attachment, it is given the attachment as the UploadInput fills it in,
+// with no Id yet, so SetAttrsForCreate is called once more for it.
+//
+// A denial wraps ErrForbidden, or another error of this package for its
+// status. Any other error is a failure to decide, and answered with a 500.
+type Authorizer interface {
+	Authorize(r *http.Request, action Action, att *Attachment) (err error)
+}
+
+// Authorize asks the Authorizer of maker, when it has one, if r may do
+// action with each of atts.
+func Authorize(maker StorageMaker, r *http.Request, action Action, atts ...*Attachment) (err error) {
+	a, ok := maker.(Authorizer)
+	if !ok {
+		return
+	}
+
+	for _, att := range atts {
+		if err = a.Authorize(r, action, att); err != nil {
+			err = fmt.Errorf("%s attachment %s: %w", action, att.Id, err)
+			return
+		}
+	}
+	return
+}
+
+// Authorized gives the ones of atts the Authorizer of maker, when it has
+// one, lets r do action with. A denial leaves the attachment out, a
+// failure to decide fails them all.
+func Authorized(maker StorageMaker, r *http.Request, action Action, atts []*Attachment) (allowed []*Attachment, err error) {
+	if _, ok := maker.(Authorizer); !ok {
+		allowed = atts
+		return
+	}
+
+	for _, att := range atts {
+		aerr := Authorize(maker, r, action, att)
+		if aerr != nil && StatusCode(aerr) >= http.StatusInternalServerError {
+			allowed, err = nil, aerr
+			return
+		}
+		if aerr == nil {
+			allowed = append(allowed, att)
+		}
+	}
+	return
+}
+
+// authorizeCreate asks the Authorizer of maker, when it has one, if r may
+// upload the attachment input would create, before anything is stored.
+func authorizeCreate(maker StorageMaker, r *http.Request, input UploadInput) (err error) {
+	if _, ok := maker.(Authorizer); !ok {
+		return
+	}
+	att := &Attachment{}
+	if err = input.SetAttrsForCreate(att); err != nil {
+		return
+	}
+	att.Filename, att.ContentType, att.ContentId = input.GetFileMeta()
+	err = Authorize(maker, r, ActionUpload, att)
+	return
+}
@@ -0,0 +1,232 @@
+package tenpu
+
+import (
+	"context"
+	"io"
+)
+
+// BlobStorageContext is BlobStorage with a context for every call, so a
+// cancelled request or a passed deadline stops the work. Storages that can
+// implement it natively should, the others are adapted by BlobContext.
+type BlobStorageContext interface {
+	OpenContext(ctx context.Context, attachment *Attachment) (r io.ReadSeekCloser, err error)
+	PutContext(ctx context.Context, filename string, contentType string, body io.Reader, attachment *Attachment) (err error)
+	DeleteContext(ctx context.Context, blobId string) (err error)
+	CopyContext(ctx context.Context, attachment *Attachment, w io.Writer) (err error)
+	CopyToStorageContext(ctx context.Context, attachment *Attachment, toBlob BlobStorage) (err error)
+	ZipContext(ctx context.Context, attachments []*Attachment, w io.Writer) (err error)
+}
+
+// MetaStorageContext is MetaStorage with a context for every call, see
+// BlobStorageContext and MetaContext.
+type MetaStorageContext interface {
+	PutContext(ctx context.Context, att *Attachment) (err error)
+	RemoveContext(ctx context.Context, id string) (err error)
+	AttachmentsContext(ctx context.Context, ownerid string) (r []*Attachment, err error)
+	AttachmentsByOwnerIdsContext(ctx context.Context, ownerids []string) (r []*Attachment, err error)
+	AttachmentsCountByOwnerIdsContext(ctx context.Context, ownerids []string) (r int, err error)
+	AttachmentByIdContext(ctx context.Context, id string) (r *Attachment, err error)
+	AttachmentByIdsContext(ctx context.Context, ids []string) (r []*Attachment, err error)
+	AttachmentsByGroupIdContext(ctx context.Context, groupId string) (r []*Attachment, err error)
+}
+
+// BlobContext gives blob as a BlobStorageContext. When blob does not
+// implement it, the calls check ctx before starting, and the bodies they
+// read or write stop with ctx.Err() once ctx is done. Storages are
+// expected to drop what they partially wrote when Put fails.
+func BlobContext(blob BlobStorage) BlobStorageContext {
+	if c, ok := blob.(BlobStorageContext); ok {
+		return c
+	}
+	return &blobContext{blob}
+}
+
+// MetaContext gives meta as a MetaStorageContext. When meta does not
+// implement it, the calls only check ctx before starting.
+func MetaContext(meta MetaStorage) MetaStorageContext {
+	if c, ok := meta.(MetaStorageContext); ok {
+		return c
+	}
+	return &metaContext{meta}
+}
+
+type blobContext struct {
+	blob BlobStorage
+}
+
+func (b *blobContext) OpenContext(ctx context.Context, attachment *Attachment) (r io.ReadSeekCloser, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	f, err := b.blob.Open(attachment)
+	if err != nil {
+		return
+	}
+	r = &contextReadSeekCloser{ctx, f}
+	return
+}
+
+func (b *blobContext) PutContext(ctx context.Context, filename string, contentType string, body io.Reader, attachment *Attachment) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = b.blob.Put(filename, contentType, &contextReader{ctx, body}, attachment)
+	return
+}
+
+func (b *blobContext) DeleteContext(ctx context.Context, blobId string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = b.blob.Delete(blobId)
+	return
+}
+
+func (b *blobContext) CopyContext(ctx context.Context, attachment *Attachment, w io.Writer) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = b.blob.Copy(attachment, &contextWriter{ctx, w})
+	if err == nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+func (b *blobContext) CopyToStorageContext(ctx context.Context, attachment *Attachment, toBlob BlobStorage) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = b.blob.CopyToStorage(attachment, &contextPutBlob{toBlob, ctx})
+	return
+}
+
+func (b *blobContext) ZipContext(ctx context.Context, attachments []*Attachment, w io.Writer) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = b.blob.Zip(attachments, &contextWriter{ctx, w})
+	if err == nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// contextPutBlob hands the target of CopyToStorage a body that stops with
+// the context.
+type contextPutBlob struct {
+	BlobStorage
+	ctx context.Context
+}
+
+func (b *contextPutBlob) Put(filename string, contentType string, body io.Reader, attachment *Attachment) (err error) {
+	err = b.BlobStorage.Put(filename, contentType, &contextReader{b.ctx, body}, attachment)
+	return
+}
+
+type metaContext struct {
+	meta MetaStorage
+}
+
+func (m *metaContext) PutContext(ctx context.Context, att *Attachment) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = m.meta.Put(att)
+	return
+}
+
+func (m *metaContext) RemoveContext(ctx context.Context, id string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = m.meta.Remove(id)
+	return
+}
+
+func (m *metaContext) AttachmentsContext(ctx context.Context, ownerid string) (r []*Attachment, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	r, err = m.meta.Attachments(ownerid)
+	return
+}
+
+func (m *metaContext) AttachmentsByOwnerIdsContext(ctx context.Context, ownerids []string) (r []*Attachment, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	r, err = m.meta.AttachmentsByOwnerIds(ownerids)
+	return
+}
+
+func (m *metaContext) AttachmentsCountByOwnerIdsContext(ctx context.Context, ownerids []string) (r int, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	r, err = m.meta.AttachmentsCountByOwnerIds(ownerids)
+	return
+}
+
+func (m *metaContext) AttachmentByIdContext(ctx context.Context, id string) (r *Attachment, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	r, err = m.meta.AttachmentById(id)
+	return
+}
+
+func (m *metaContext) AttachmentByIdsContext(ctx context.Context, ids []string) (r []*Attachment, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	r, err = m.meta.AttachmentByIds(ids)
+	return
+}
+
+func (m *metaContext) AttachmentsByGroupIdContext(ctx context.Context, groupId string) (r []*Attachment, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	r, err = m.meta.AttachmentsByGroupId(groupId)
+	return
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (n int, err error) {
+	if err = r.ctx.Err(); err != nil {
+		return
+	}
+	n, err = r.r.Read(p)
+	return
+}
+
+type contextReadSeekCloser struct {
+	ctx context.Context
+	io.ReadSeekCloser
+}
+
+func (r *contextReadSeekCloser) Read(p []byte) (n int, err error) {
+	if err = r.ctx.Err(); err != nil {
+		return
+	}
+	n, err = r.ReadSeekCloser.Read(p)
+	return
+}
+
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (n int, err error) {
+	if err = w.ctx.Err(); err != nil {
+		return
+	}
+	n, err = w.w.Write(p)
+	return
+}
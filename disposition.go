@@ -0,0 +1,79 @@
+package tenpu
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// The disposition types of ContentDisposition.
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+// ZipFilename is the name zip downloads are saved as, unless the Input is
+// a ZipNameInput.
+var ZipFilename = "attachments.zip"
+
+// ZipNameInput is implemented by the Inputs that name their zip download.
+type ZipNameInput interface {
+	GetZipName() (filename string)
+}
+
+// ContentDisposition makes a Content-Disposition header value of RFC 6266
+// for filename. The name goes in a quoted filename parameter with anything
+// outside printable ASCII replaced, for old clients, and in full as the
+// filename* parameter of RFC 5987.
+func ContentDisposition(dispositionType string, filename string) string {
+	if filename == "" {
+		return dispositionType
+	}
+	fallback := asciiFilename(filename)
+	if fallback == filename {
+		return fmt.Sprintf(`%s; filename="%s"`, dispositionType, fallback)
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, dispositionType, fallback, encodeRFC5987(filename))
+}
+
+// asciiFilename replaces what can not be safely put in a quoted-string
+// header parameter.
+func asciiFilename(filename string) string {
+	var buf strings.Builder
+	for _, c := range filename {
+		switch {
+		case c == '"' || c == '\\' || c == '%':
+			buf.WriteByte('_')
+		case c < 0x20 || c == 0x7f:
+			buf.WriteByte('_')
+		case c >= utf8.RuneSelf:
+			buf.WriteByte('_')
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+// encodeRFC5987 percent-encodes the UTF-8 bytes of s that are not an
+// attr-char.
+func encodeRFC5987(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAttrChar(c) {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
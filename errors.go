@@ -0,0 +1,42 @@
+package tenpu
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Errors every storage maps its own failures to, so callers can tell them
+// apart with errors.Is whatever the backend. Inputs can wrap them too, for
+// example SetAttrsForCreate returning ErrForbidden makes the upload a 403.
+var (
+	ErrNotFound  = errors.New("tenpu: not found")
+	ErrTooLarge  = errors.New("tenpu: too large")
+	ErrForbidden = errors.New("tenpu: forbidden")
+	ErrInvalid   = errors.New("tenpu: invalid")
+	// ErrConflict is for a change made on a state of the attachment another
+	// change has replaced meanwhile, it can be retried.
+	ErrConflict = errors.New("tenpu: conflict")
+)
+
+// StatusCode is the HTTP status handlers answer with for err.
+func StatusCode(err error) int {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTooLarge), errors.As(err, &maxBytes):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
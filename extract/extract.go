@@ -0,0 +1,243 @@
+// Package extract pulls the plain text out of uploaded documents, so they
+// can be searched by their content. It reads text/*, CSV, JSON, HTML, the
+// Office Open XML documents (DOCX, XLSX and PPTX) and simple PDFs, without
+// anything outside of Go.
+//
+// An Extractor is a tenpu.PostUploader: embed it in a StorageMaker, and the
+// handlers set the Text of each attachment after its upload.
+package extract
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/theplant/tenpu"
+)
+
+// The caps of an Extractor when its own are zero.
+const (
+	DefaultMaxFileSize   = 20 << 20
+	DefaultMaxTextLength = 64 << 10
+)
+
+// ErrUnsupported is given for the bodies no format of the package reads.
+var ErrUnsupported = errors.New("extract: unsupported format")
+
+// Extractor sets the Text of attachments. The caps keep a huge or hostile
+// file from stalling the upload it runs after.
+type Extractor struct {
+	// MaxFileSize is the largest body read, the text of larger ones is not
+	// extracted.
+	MaxFileSize int64
+	// MaxTextLength is the most bytes of text kept, the rest is dropped.
+	MaxTextLength int
+}
+
+// format reads the text of a body into w.
+type format func(body []byte, w *textWriter) (err error)
+
+// PostUpload extracts the text of att with the context of r, see Store.
+func (e *Extractor) PostUpload(r *http.Request, blob tenpu.BlobStorage, meta tenpu.MetaStorage, att *tenpu.Attachment) (err error) {
+	return e.Store(r.Context(), blob, meta, att)
+}
+
+// Store sets the Text of att from its body, and stores it in meta. The
+// attachments of a format it does not read, or too large, are left as they
+// are.
+func (e *Extractor) Store(ctx context.Context, blob tenpu.BlobStorage, meta tenpu.MetaStorage, att *tenpu.Attachment) (err error) {
+	read := formatOf(att.ContentType, att.Filename)
+	if read == nil {
+		return
+	}
+	if att.ContentLength > e.maxFileSize() {
+		log.Printf("tenpu: extract text of file id:%s skipped, size:%d", att.Id, att.ContentLength)
+		return
+	}
+
+	body, err := tenpu.BlobContext(blob).OpenContext(ctx, att)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, e.maxFileSize()))
+	if err != nil {
+		return
+	}
+	if att.Text, err = e.extract(read, b); err != nil {
+		return
+	}
+	err = tenpu.MetaContext(meta).PutContext(ctx, att)
+	return
+}
+
+// Text extracts the text of body, of the format told by its content type
+// or else its filename extension.
+func (e *Extractor) Text(contentType string, filename string, body []byte) (text string, err error) {
+	read := formatOf(contentType, filename)
+	if read == nil {
+		err = fmt.Errorf("%w: %s %s", ErrUnsupported, contentType, filename)
+		return
+	}
+	if int64(len(body)) > e.maxFileSize() {
+		err = fmt.Errorf("extract: body of %d bytes is over the cap", len(body))
+		return
+	}
+	return e.extract(read, body)
+}
+
+func (e *Extractor) extract(read format, body []byte) (text string, err error) {
+	w := &textWriter{max: e.maxTextLength()}
+	if err = read(body, w); err != nil && err != errFull {
+		return
+	}
+	err = nil
+	text = w.String()
+	return
+}
+
+func (e *Extractor) maxFileSize() int64 {
+	if e.MaxFileSize > 0 {
+		return e.MaxFileSize
+	}
+	return DefaultMaxFileSize
+}
+
+func (e *Extractor) maxTextLength() int {
+	if e.MaxTextLength > 0 {
+		return e.MaxTextLength
+	}
+	return DefaultMaxTextLength
+}
+
+const (
+	docxType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	xlsxType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	pptxType = "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+)
+
+func formatOf(contentType string, filename string) format {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch contentType {
+	case "text/html", "application/xhtml+xml":
+		return readHTML
+	case "text/csv", "application/csv":
+		return readCSV
+	case "application/json":
+		return readJSON
+	case docxType:
+		return readDOCX
+	case xlsxType:
+		return readXLSX
+	case pptxType:
+		return readPPTX
+	case "application/pdf":
+		return readPDF
+	}
+	if strings.HasPrefix(contentType, "text/") {
+		return readPlain
+	}
+
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".html", ".htm":
+		return readHTML
+	case ".csv":
+		return readCSV
+	case ".json":
+		return readJSON
+	case ".txt", ".md":
+		return readPlain
+	case ".docx":
+		return readDOCX
+	case ".xlsx":
+		return readXLSX
+	case ".pptx":
+		return readPPTX
+	case ".pdf":
+		return readPDF
+	}
+	return nil
+}
+
+// errFull stops a format once the text is at its cap.
+var errFull = errors.New("extract: text is full")
+
+// textWriter collects text up to a cap, with the runs of white space within
+// a line made one space, and no blank lines.
+type textWriter struct {
+	buf   bytes.Buffer
+	max   int
+	space bool
+	full  bool
+}
+
+// add appends s, it gives errFull once the cap is reached.
+func (w *textWriter) add(s string) (err error) {
+	for _, c := range strings.ToValidUTF8(s, "\ufffd") {
+		if c == '\n' {
+			w.newline()
+			continue
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v' || c == 0xa0 {
+			w.space = w.buf.Len() > 0 && !bytes.HasSuffix(w.buf.Bytes(), []byte("\n"))
+			continue
+		}
+		if c < ' ' {
+			continue
+		}
+		if w.space {
+			w.space = false
+			if err = w.write(" "); err != nil {
+				return
+			}
+		}
+		if err = w.write(string(c)); err != nil {
+			return
+		}
+	}
+	if w.full {
+		err = errFull
+	}
+	return
+}
+
+func (w *textWriter) newline() {
+	w.space = false
+	if w.buf.Len() > 0 && !bytes.HasSuffix(w.buf.Bytes(), []byte("\n")) {
+		w.write("\n")
+	}
+}
+
+func (w *textWriter) write(s string) (err error) {
+	if w.full || w.buf.Len()+len(s) > w.max {
+		w.full = true
+		return errFull
+	}
+	w.buf.WriteString(s)
+	return
+}
+
+func (w *textWriter) String() string {
+	return strings.TrimRight(w.buf.String(), " \n")
+}
+
+// decodeText reads b as UTF-8, or as Latin-1 when it is not valid UTF-8.
+func decodeText(b []byte) string {
+	if utf8.Valid(b) {
+		return string(bytes.TrimPrefix(b, []byte("\ufeff")))
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
@@ -0,0 +1,128 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The Office Open XML documents are zips of XML parts, their text is in
+// the "t" elements, DOCX and PPTX paragraphs are "p" elements, and XLSX
+// keeps its strings in "si" elements.
+
+func readDOCX(body []byte, w *textWriter) (err error) {
+	return readParts(body, w, func(name string) bool {
+		return name == "word/document.xml"
+	})
+}
+
+func readXLSX(body []byte, w *textWriter) (err error) {
+	return readParts(body, w, func(name string) bool {
+		return name == "xl/sharedStrings.xml" || (strings.HasPrefix(name, "xl/worksheets/sheet") && strings.HasSuffix(name, ".xml"))
+	})
+}
+
+func readPPTX(body []byte, w *textWriter) (err error) {
+	return readParts(body, w, func(name string) bool {
+		return strings.HasPrefix(name, "ppt/slides/slide") && strings.HasSuffix(name, ".xml")
+	})
+}
+
+// readParts reads the text of the parts of the zip body that match, in
+// the order of the numbers in their names, so slide10 follows slide9.
+func readParts(body []byte, w *textWriter, match func(name string) bool) (err error) {
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return
+	}
+
+	var parts []*zip.File
+	for _, f := range zr.File {
+		if match(f.Name) {
+			parts = append(parts, f)
+		}
+	}
+	sort.SliceStable(parts, func(i, j int) bool {
+		a, na := partNumber(parts[i].Name)
+		b, nb := partNumber(parts[j].Name)
+		if a != b {
+			return a < b
+		}
+		return na < nb
+	})
+
+	for _, f := range parts {
+		var r io.ReadCloser
+		if r, err = f.Open(); err != nil {
+			return
+		}
+		// the text is capped, but a part inflating to much more than the
+		// whole file is not read past that
+		err = readXMLText(io.LimitReader(r, int64(len(body))*100), w)
+		r.Close()
+		if err != nil {
+			return
+		}
+		w.newline()
+	}
+	return
+}
+
+// partNumber splits the part name into what comes before its number, and
+// the number, which is before ".xml".
+func partNumber(name string) (prefix string, n int) {
+	name = strings.TrimSuffix(name, ".xml")
+	i := len(name)
+	for i > 0 && '0' <= name[i-1] && name[i-1] <= '9' {
+		i--
+	}
+	prefix = name[:i]
+	n, _ = strconv.Atoi(name[i:])
+	return
+}
+
+func readXMLText(r io.Reader, w *textWriter) (err error) {
+	dec := xml.NewDecoder(r)
+	inText := 0
+	for {
+		var tok xml.Token
+		tok, err = dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText++
+			case "tab":
+				w.add(" ")
+			case "br", "cr":
+				w.newline()
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText--
+			case "p", "si", "row":
+				w.newline()
+			case "c", "tc":
+				w.add(" ")
+			}
+		case xml.CharData:
+			if inText > 0 {
+				if err = w.add(string(t)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
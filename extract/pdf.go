@@ -0,0 +1,291 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+)
+
+// The PDFs read are the simple ones: the text of their content streams,
+// uncompressed or with FlateDecode, drawn with fonts of a one byte
+// encoding. The text of CID fonts, or of images, is not found.
+
+var (
+	streamKeyword = []byte("stream")
+	filterName    = regexp.MustCompile(`/([A-Za-z0-9]+Decode)\b`)
+	// skippedStreams hold no page text
+	skippedStreams = regexp.MustCompile(`/(Image|Length1|Length2|Length3|XRef|ObjStm|Metadata|EmbeddedFile)\b`)
+)
+
+func readPDF(body []byte, w *textWriter) (err error) {
+	if !bytes.HasPrefix(body, []byte("%PDF-")) {
+		return ErrUnsupported
+	}
+
+	pos := 0
+	for {
+		i := bytes.Index(body[pos:], streamKeyword)
+		if i < 0 {
+			return
+		}
+		start := pos + i
+		pos = start + len(streamKeyword)
+		if start > 0 && body[start-1] == 'd' {
+			// the end of the previous stream
+			continue
+		}
+
+		dict := body[:start]
+		if j := bytes.LastIndex(dict, []byte("obj")); j >= 0 {
+			dict = dict[j:]
+		}
+		data := body[pos:]
+		data = bytes.TrimPrefix(data, []byte("\r"))
+		data = bytes.TrimPrefix(data, []byte("\n"))
+		end := bytes.Index(data, []byte("endstream"))
+		if end < 0 {
+			return
+		}
+		data = data[:end]
+		pos += end
+
+		if skippedStreams.Match(dict) {
+			continue
+		}
+		if data, err = decodeStream(dict, data, w.max); err != nil {
+			// a stream of a filter we do not read
+			err = nil
+			continue
+		}
+		if err = readContent(data, w); err != nil {
+			return
+		}
+	}
+}
+
+// decodeStream undoes the FlateDecode filter of data, the other filters
+// are not read.
+func decodeStream(dict []byte, data []byte, max int) (r []byte, err error) {
+	flate := false
+	for _, m := range filterName.FindAllSubmatch(dict, -1) {
+		if string(m[1]) != "FlateDecode" {
+			err = ErrUnsupported
+			return
+		}
+		flate = true
+	}
+	if !flate {
+		return data, nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	// content streams are mostly operators, so their inflated size is
+	// capped at a multiple of the text kept
+	r, err = ioutil.ReadAll(io.LimitReader(zr, int64(max)*20))
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+// readContent adds the strings the text operators of a content stream
+// draw.
+func readContent(data []byte, w *textWriter) (err error) {
+	var strs [][]byte
+	var nums []float64
+	inText := false
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '(':
+			var s []byte
+			s, i = literalString(data, i)
+			strs = append(strs, s)
+			continue
+		case c == '<' && i+1 < len(data) && data[i+1] != '<':
+			var s []byte
+			s, i = hexString(data, i)
+			strs = append(strs, s)
+			continue
+		case c == '%':
+			for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+				i++
+			}
+			continue
+		case c == '-' || c == '+' || c == '.' || ('0' <= c && c <= '9'):
+			j := i + 1
+			for j < len(data) && (data[j] == '.' || ('0' <= data[j] && data[j] <= '9')) {
+				j++
+			}
+			if n, perr := strconv.ParseFloat(string(data[i:j]), 64); perr == nil {
+				nums = append(nums, n)
+				// a large gap in a TJ array is a space
+				if n < -200 && len(strs) > 0 {
+					strs = append(strs, []byte(" "))
+				}
+			}
+			i = j
+			continue
+		case ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '\'' || c == '"' || c == '*':
+			j := i + 1
+			for j < len(data) && (('a' <= data[j] && data[j] <= 'z') || ('A' <= data[j] && data[j] <= 'Z') || data[j] == '*') {
+				j++
+			}
+			op := string(data[i:j])
+			i = j
+
+			switch op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				w.newline()
+			case "Tj", "TJ":
+				if inText {
+					err = addStrings(strs, w)
+				}
+			case "'", "\"", "T*":
+				w.newline()
+				if inText && op != "T*" {
+					err = addStrings(strs, w)
+				}
+			case "Td", "TD":
+				if len(nums) >= 2 && nums[len(nums)-1] != 0 {
+					w.newline()
+				} else {
+					w.add(" ")
+				}
+			}
+			if err != nil {
+				return
+			}
+			strs, nums = strs[:0], nums[:0]
+			continue
+		case c == '/':
+			// a name, like the font of Tf
+			j := i + 1
+			for j < len(data) && !isPDFDelimiter(data[j]) {
+				j++
+			}
+			i = j
+			continue
+		}
+		i++
+	}
+	return
+}
+
+func addStrings(strs [][]byte, w *textWriter) (err error) {
+	for _, s := range strs {
+		if err = w.add(pdfText(s)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// pdfText decodes a PDF text string: UTF-16 with a byte order mark, or
+// else one byte per character, read as Latin-1.
+func pdfText(s []byte) string {
+	if len(s) >= 2 && s[0] == 0xfe && s[1] == 0xff {
+		u := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			u = append(u, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		return string(utf16.Decode(u))
+	}
+	r := make([]rune, len(s))
+	for i, c := range s {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// literalString reads the (string) at data[i], with its escapes and
+// nested parentheses, and gives the index after it.
+func literalString(data []byte, i int) (s []byte, next int) {
+	depth := 0
+	for i++; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return s, i + 1
+			}
+			depth--
+		case '\\':
+			i++
+			if i >= len(data) {
+				return s, i
+			}
+			switch e := data[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// a line continuation
+				if e == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+					i++
+				}
+			default:
+				if '0' <= e && e <= '7' {
+					n := 0
+					for k := 0; k < 3 && i < len(data) && '0' <= data[i] && data[i] <= '7'; k++ {
+						n = n*8 + int(data[i]-'0')
+						i++
+					}
+					i--
+					s = append(s, byte(n))
+					continue
+				}
+				s = append(s, e)
+			}
+			continue
+		}
+		s = append(s, c)
+	}
+	return s, i
+}
+
+// hexString reads the <hex string> at data[i], and gives the index after
+// it.
+func hexString(data []byte, i int) (s []byte, next int) {
+	var digits []byte
+	for i++; i < len(data) && data[i] != '>'; i++ {
+		c := data[i]
+		if ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F') {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	for k := 0; k < len(digits); k += 2 {
+		n, _ := strconv.ParseUint(string(digits[k:k+2]), 16, 8)
+		s = append(s, byte(n))
+	}
+	return s, i + 1
+}
+
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '\f', 0, '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
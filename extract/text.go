@@ -0,0 +1,213 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+func readPlain(body []byte, w *textWriter) (err error) {
+	return w.add(decodeText(body))
+}
+
+// readCSV gives the cells of each record on a line, a body that is not
+// valid CSV is read as plain text.
+func readCSV(body []byte, w *textWriter) (err error) {
+	r := csv.NewReader(strings.NewReader(decodeText(body)))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	var records [][]string
+	for {
+		var record []string
+		record, err = r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return readPlain(body, w)
+		}
+		records = append(records, record)
+	}
+
+	for _, record := range records {
+		if err = w.add(strings.Join(record, " ")); err != nil {
+			return
+		}
+		w.newline()
+	}
+	return
+}
+
+// readJSON gives the strings and numbers of a JSON document, each on a
+// line, the object keys in order. A body that is not valid JSON is read as
+// plain text.
+func readJSON(body []byte, w *textWriter) (err error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err = dec.Decode(&v); err != nil {
+		return readPlain(body, w)
+	}
+	return addJSON(v, w)
+}
+
+func addJSON(v interface{}, w *textWriter) (err error) {
+	switch v := v.(type) {
+	case string:
+		err = w.add(v)
+		w.newline()
+	case json.Number:
+		err = w.add(v.String())
+		w.newline()
+	case []interface{}:
+		for _, e := range v {
+			if err = addJSON(e, w); err != nil {
+				return
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err = addJSON(v[k], w); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// blockTags end a line of the text of an HTML document.
+var blockTags = map[string]bool{
+	"br": true, "p": true, "div": true, "li": true, "tr": true, "h1": true, "h2": true,
+	"h3": true, "h4": true, "h5": true, "h6": true, "title": true, "table": true,
+	"ul": true, "ol": true, "section": true, "article": true, "blockquote": true, "pre": true,
+}
+
+// readHTML strips the tags, comments, scripts and styles of an HTML
+// document, and unescapes its entities.
+func readHTML(body []byte, w *textWriter) (err error) {
+	s := decodeText(body)
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			return w.add(html.UnescapeString(s))
+		}
+		if err = w.add(html.UnescapeString(s[:i])); err != nil {
+			return
+		}
+		s = s[i:]
+
+		if strings.HasPrefix(s, "<!--") {
+			s = after(s, "-->")
+			continue
+		}
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			return
+		}
+		name := tagName(s[1:end])
+		s = s[end+1:]
+
+		switch name {
+		case "head":
+			// only the title of the head is text
+			s = skipHead(s, w)
+			continue
+		case "script", "style":
+			s = afterFold(s, "</"+name)
+			continue
+		}
+		if blockTags[strings.TrimPrefix(name, "/")] {
+			w.newline()
+		} else {
+			w.add(" ")
+		}
+	}
+	return
+}
+
+// skipHead adds the title of the head s starts in, and gives what follows
+// the head.
+func skipHead(s string, w *textWriter) string {
+	head := s
+	if i := indexFold(s, "</head"); i >= 0 {
+		head = s[:i]
+	}
+	if i := indexFold(head, "<title"); i >= 0 {
+		title := head[i:]
+		if j := strings.IndexByte(title, '>'); j >= 0 {
+			title = title[j+1:]
+			if k := indexFold(title, "</title"); k >= 0 {
+				title = title[:k]
+			}
+			w.add(html.UnescapeString(title))
+			w.newline()
+		}
+	}
+	return afterFold(s, "</head")
+}
+
+// tagName is the lower case name of the tag t is the inside of, with the
+// "/" of an end tag.
+func tagName(t string) string {
+	end := strings.IndexFunc(t, func(c rune) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '>' || (c == '/' && len(t) > 0 && t[0] != '/')
+	})
+	if end >= 0 {
+		t = t[:end]
+	}
+	return strings.ToLower(t)
+}
+
+// after is what follows sep in s, empty if there is none.
+func after(s string, sep string) string {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[i+len(sep):]
+	}
+	return ""
+}
+
+// afterFold is what follows the tag starting with the ASCII case
+// insensitive prefix in s, empty if there is none.
+func afterFold(s string, prefix string) string {
+	i := indexFold(s, prefix)
+	if i < 0 {
+		return ""
+	}
+	s = s[i:]
+	if j := strings.IndexByte(s, '>'); j >= 0 {
+		return s[j+1:]
+	}
+	return ""
+}
+
+// indexFold is strings.Index ignoring the case of ASCII letters, sep must
+// be lower case.
+func indexFold(s string, sep string) int {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		match := true
+		for j := 0; j < len(sep); j++ {
+			c := s[i+j]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c != sep[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
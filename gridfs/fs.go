@@ -1,7 +1,6 @@
 package gridfs
 
 import (
-	"archive/zip"
 
 	_ "golang.org/x/image/bmp"
 	"github.com/theplant/mgodb"
@@ -12,7 +11,6 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
-	"log"
 )
 
 type Storage struct {
@@ -27,20 +25,26 @@ func (s *Storage) Put(filename string, contentType string, body io.Reader, attac
 	var f *mgo.GridFile
 	s.database.DatabaseDo(func(db *mgo.Database) {
 		f, err = db.GridFS("fs").Create(filename)
-		defer f.Close()
 		if err != nil {
-			panic(err)
+			return
 		}
-		if attachment.Id != "" {
-			f.SetId(bson.ObjectIdHex(attachment.Id))
+		if attachment.BodyId() != "" {
+			f.SetId(bson.ObjectIdHex(attachment.BodyId()))
 		}
 		f.SetContentType(contentType)
 		_, err = io.Copy(f, body)
+		if err != nil {
+			// a broken or cancelled body, drop the chunks written so far
+			f.Abort()
+			f.Close()
+			return
+		}
+		// Close writes the last chunk and the file document, and removes
+		// the chunks when that fails
+		err = f.Close()
 	})
 
-	if err == io.ErrUnexpectedEOF {
-		attId := f.Id().(bson.ObjectId)
-		s.Delete(attId.Hex())
+	if err != nil {
 		return
 	}
 
@@ -52,7 +56,7 @@ func (s *Storage) Put(filename string, contentType string, body io.Reader, attac
 		attachment.MD5 = f.MD5()
 		if attachment.IsImage() {
 			s.database.DatabaseDo(func(db *mgo.Database) {
-				f, err := db.GridFS("fs").OpenId(bson.ObjectIdHex(attachment.Id))
+				f, err := db.GridFS("fs").OpenId(bson.ObjectIdHex(attachment.BodyId()))
 				if err == nil {
 					config, _, err := image.DecodeConfig(f)
 					f.Close()
@@ -72,11 +76,12 @@ func (s *Storage) CopyToStorage(attachment *tenpu.Attachment, toBlob tenpu.BlobS
 	session := s.database.GetOrDialSession().Copy()
 	defer session.Close()
 	db := session.DB(s.database.DatabaseName)
-	reader, err := db.GridFS("fs").OpenId(bson.ObjectIdHex(attachment.Id))
+	reader, err := db.GridFS("fs").OpenId(bson.ObjectIdHex(attachment.BodyId()))
 	if err == nil {
 		defer reader.Close()
 	} else {
 		// log.Println("open file error: ", attachment.Id, attachment.Filename)
+		err = mapError(err)
 		return
 	}
 	err = toBlob.Put(attachment.Filename, attachment.ContentType, reader, attachment)
@@ -84,73 +89,48 @@ func (s *Storage) CopyToStorage(attachment *tenpu.Attachment, toBlob tenpu.BlobS
 	return
 }
 
-// Have Session problem
-// func (s *Storage) Get(attachment *tenpu.Attachment) (r io.Reader, err error) {
+// gridFile keeps the session it was opened with alive until it is closed,
+// the file reads its chunks through that session.
+type gridFile struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
 
-// 	s.database.DatabaseDo(func(db *mgo.Database) {
-// 		r, err = db.GridFS("fs").OpenId(bson.ObjectIdHex(attachment.Id))
-// 	})
-// 	return
-// }
+func (f *gridFile) Close() (err error) {
+	err = f.GridFile.Close()
+	f.session.Close()
+	return
+}
+
+func (s *Storage) Open(attachment *tenpu.Attachment) (r io.ReadSeekCloser, err error) {
+	session := s.database.GetOrDialSession().Copy()
+	f, err := session.DB(s.database.DatabaseName).GridFS("fs").OpenId(bson.ObjectIdHex(attachment.BodyId()))
+	if err != nil {
+		session.Close()
+		err = mapError(err)
+		return
+	}
+	r = &gridFile{GridFile: f, session: session}
+	return
+}
 
 func (s *Storage) Copy(attachment *tenpu.Attachment, w io.Writer) (err error) {
 	s.database.DatabaseDo(func(db *mgo.Database) {
-		f, err := db.GridFS("fs").OpenId(bson.ObjectIdHex(attachment.Id))
+		var f *mgo.GridFile
+		f, err = db.GridFS("fs").OpenId(bson.ObjectIdHex(attachment.BodyId()))
 		if err == nil {
 			defer f.Close()
-			io.Copy(w, f)
+			_, err = io.Copy(w, f)
 		} else {
 			// log.Println("open file error: ", attachment.Id, attachment.Filename)
 		}
 	})
+	err = mapError(err)
 	return
 }
 
 func (s *Storage) Zip(attachments []*tenpu.Attachment, w io.Writer) (err error) {
-	// Create a buffer to write our archive to.
-	// buf := new(bytes.Buffer)
-
-	// Create a new zip archive.
-	zipfile := zip.NewWriter(w)
-
-	attNameMap := make(map[string]bool)
-	attMD5Map := make(map[string]bool)
-
-	// Add some files to the archive.
-	for _, att := range attachments {
-
-		if _, ok := attNameMap[att.Filename]; ok {
-			if _, ok := attMD5Map[att.MD5+att.Filename]; ok {
-				continue
-			} else {
-				att.Filename = att.MD5 + "_" + att.Filename
-				attMD5Map[att.MD5+att.Filename] = true
-			}
-		} else {
-			attNameMap[att.Filename] = true
-			attMD5Map[att.MD5+att.Filename] = true
-		}
-		f, _ := zipfile.Create(att.Filename)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		err = s.Copy(att, f)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-	}
-
-	// Make sure to check the error on Close.
-	err = zipfile.Close()
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	// _, err = buf.WriteTo(w)
-	return
+	return tenpu.WriteZip(s, attachments, w)
 }
 
 func NewStorage(db *mgodb.Database) (s *Storage) {
@@ -166,5 +146,14 @@ func (s *Storage) Delete(attachmentId string) (err error) {
 	s.database.DatabaseDo(func(db *mgo.Database) {
 		err = db.GridFS("fs").RemoveId(bson.ObjectIdHex(attachmentId))
 	})
+	err = mapError(err)
 	return
 }
+
+// mapError turns the mgo not found into tenpu.ErrNotFound.
+func mapError(err error) error {
+	if err == mgo.ErrNotFound {
+		return tenpu.ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,386 @@
+package tenpu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// GroupStats is the size of a group of attachments.
+type GroupStats struct {
+	GroupId string
+	Count   int
+	// Size is the sum of the ContentLength of the attachments.
+	Size int64
+}
+
+// GroupCounter is implemented by MetaStorages that can total groups without
+// loading their attachments, see CountGroups.
+type GroupCounter interface {
+	// GroupStats gives the stats of each of groupIds, in the same order.
+	GroupStats(groupIds []string) (r []*GroupStats, err error)
+}
+
+// GroupInput is implemented by the Inputs that address a group of
+// attachments, for MakeGroupZipFileLoader.
+type GroupInput interface {
+	GetGroupId() (groupId string)
+}
+
+// CountGroups gives the stats of each of groupIds, not counting the
+// attachments in the trash.
+func CountGroups(meta MetaStorage, groupIds ...string) (r []*GroupStats, err error) {
+	if gc, ok := meta.(GroupCounter); ok {
+		return gc.GroupStats(groupIds)
+	}
+
+	for _, groupId := range groupIds {
+		var atts []*Attachment
+		if atts, err = meta.AttachmentsByGroupId(groupId); err != nil {
+			return
+		}
+		stats := &GroupStats{GroupId: groupId, Count: len(atts)}
+		for _, att := range atts {
+			stats.Size += att.ContentLength
+		}
+		r = append(r, stats)
+	}
+	return
+}
+
+func AddToGroup(meta MetaStorage, groupId string, ids ...string) (r []*Attachment, err error) {
+	return AddToGroupContext(context.Background(), meta, groupId, ids...)
+}
+
+// AddToGroupContext puts the attachments of ids in the group, it gives the
+// ones it changed.
+func AddToGroupContext(ctx context.Context, meta MetaStorage, groupId string, ids ...string) (r []*Attachment, err error) {
+	if groupId == "" {
+		err = fmt.Errorf("%w: group id required", ErrInvalid)
+		return
+	}
+	atts, err := groupMembers(ctx, meta, ids)
+	if err != nil {
+		return
+	}
+	r, err = regroup(ctx, meta, atts, func(groupIds []string) []string {
+		if containsAny(groupIds, []string{groupId}) {
+			return groupIds
+		}
+		return append(groupIds, groupId)
+	})
+	return
+}
+
+func RemoveFromGroup(meta MetaStorage, groupId string, ids ...string) (r []*Attachment, err error) {
+	return RemoveFromGroupContext(context.Background(), meta, groupId, ids...)
+}
+
+// RemoveFromGroupContext takes the attachments of ids out of the group, it
+// gives the ones it changed.
+func RemoveFromGroupContext(ctx context.Context, meta MetaStorage, groupId string, ids ...string) (r []*Attachment, err error) {
+	atts, err := groupMembers(ctx, meta, ids)
+	if err != nil {
+		return
+	}
+	r, err = regroup(ctx, meta, atts, func(groupIds []string) []string {
+		return withoutGroup(groupIds, groupId)
+	})
+	return
+}
+
+func RenameGroup(meta MetaStorage, from string, to string) (r []*Attachment, err error) {
+	return RenameGroupContext(context.Background(), meta, from, to)
+}
+
+// RenameGroupContext moves the attachments of group from to group to, which
+// must be empty, use MergeGroups to join two groups.
+func RenameGroupContext(ctx context.Context, meta MetaStorage, from string, to string) (r []*Attachment, err error) {
+	if to == "" {
+		err = fmt.Errorf("%w: group id required", ErrInvalid)
+		return
+	}
+	existing, err := MetaContext(meta).AttachmentsByGroupIdContext(ctx, to)
+	if err != nil {
+		return
+	}
+	if len(existing) > 0 {
+		err = fmt.Errorf("%w: group %s already exists", ErrInvalid, to)
+		return
+	}
+	r, err = MergeGroupsContext(ctx, meta, to, from)
+	return
+}
+
+func MergeGroups(meta MetaStorage, into string, from ...string) (r []*Attachment, err error) {
+	return MergeGroupsContext(context.Background(), meta, into, from...)
+}
+
+// MergeGroupsContext moves the attachments of the groups from into the
+// group into, it gives the ones it changed. Attachments in the trash are
+// left in their groups.
+func MergeGroupsContext(ctx context.Context, meta MetaStorage, into string, from ...string) (r []*Attachment, err error) {
+	if into == "" {
+		err = fmt.Errorf("%w: group id required", ErrInvalid)
+		return
+	}
+	cmeta := MetaContext(meta)
+
+	for _, groupId := range from {
+		if groupId == into {
+			continue
+		}
+		var atts, changed []*Attachment
+		if atts, err = cmeta.AttachmentsByGroupIdContext(ctx, groupId); err != nil {
+			return
+		}
+		changed, err = regroup(ctx, meta, atts, func(groupIds []string) []string {
+			groupIds = withoutGroup(groupIds, groupId)
+			if !containsAny(groupIds, []string{into}) {
+				groupIds = append(groupIds, into)
+			}
+			return groupIds
+		})
+		r = append(r, changed...)
+		if err != nil {
+			return
+		}
+		log.Printf("Merge group:%s into group:%s, %d files", groupId, into, len(changed))
+	}
+	return
+}
+
+// groupMembers loads the attachments of ids, they all must exist and not
+// be in the trash.
+func groupMembers(ctx context.Context, meta MetaStorage, ids []string) (r []*Attachment, err error) {
+	if r, err = MetaContext(meta).AttachmentByIdsContext(ctx, ids); err != nil {
+		return
+	}
+	found := map[string]bool{}
+	for _, att := range r {
+		found[att.Id] = true
+	}
+	for _, id := range ids {
+		if !found[id] {
+			r = nil
+			err = fmt.Errorf("%w: attachment id %s", ErrNotFound, id)
+			return
+		}
+	}
+	return
+}
+
+// regroup sets the GroupId of each of atts with change, and stores the ones
+// that changed. Each is changed as it is stored, see updateAttachment, the
+// ones in the trash by then are left in their groups.
+func regroup(ctx context.Context, meta MetaStorage, atts []*Attachment, change func(groupIds []string) []string) (r []*Attachment, err error) {
+	for _, att := range atts {
+		var moved bool
+		if att, err = updateAttachment(ctx, meta, att.Id, func(att *Attachment) (err error) {
+			groupIds := change(append([]string(nil), att.GroupId...))
+			moved = !att.Trashed() && !equalStrings(groupIds, att.GroupId)
+			if !moved {
+				return errUnchanged
+			}
+			att.GroupId = groupIds
+			return
+		}); err != nil {
+			return
+		}
+		if moved {
+			r = append(r, att)
+		}
+	}
+	return
+}
+
+func withoutGroup(groupIds []string, groupId string) (r []string) {
+	for _, id := range groupIds {
+		if id != groupId {
+			r = append(r, id)
+		}
+	}
+	return
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// MakeGroupZipFileLoader downloads all attachments of the group of the
+// GroupInput as one zip, named after the group unless the Input is a
+// ZipNameInput.
+func MakeGroupZipFileLoader(maker StorageMaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storage, meta, input, err := maker.MakeForRead(r)
+		if err != nil {
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
+		gi, ok := input.(GroupInput)
+		if !ok || gi.GetGroupId() == "" {
+			err = fmt.Errorf("%w: group id required", ErrInvalid)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+		groupId := gi.GetGroupId()
+
+		atts, err := MetaContext(meta).AttachmentsByGroupIdContext(r.Context(), groupId)
+		if err != nil {
+			log.Printf("tenpu: load group %s for zip error: %v\n", groupId, err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+		if len(atts) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if err = Authorize(maker, r, ActionDownload, atts...); err != nil {
+			log.Printf("tenpu: load zip of group %s refused: %v\n", groupId, err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
+		writeZip(w, r, storage, input, atts, groupId+".zip")
+	}
+}
+
+// APIGroup is the body of the responses of MakeGroupAPI.
+type APIGroup struct {
+	GroupStats
+	Attachments []*Attachment
+}
+
+// GroupPatch changes a group with PATCH. The changes are made in the order
+// of the fields.
+type GroupPatch struct {
+	// Merge are groups whose attachments are moved into this one.
+	Merge []string
+	// Add and Remove are attachment ids put in or taken out of the group.
+	Add    []string
+	Remove []string
+	// Name, when set, renames the group, see RenameGroup.
+	Name string
+}
+
+// MakeGroupAPI serves groups as JSON under basePath:
+//
+//	GET   basePath/{group}  the group with its stats and attachments
+//	PATCH basePath/{group}  changes it with a GroupPatch body
+//
+// Errors are an APIError with the status of StatusCode, as with MakeAPI.
+// Reading a group needs ActionRead on all of its attachments, and changing
+// it ActionUpload on all the attachments it changes.
+func MakeGroupAPI(maker StorageMaker, basePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, meta, _, err := maker.MakeForRead(r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		cmeta := MetaContext(meta)
+		ctx := r.Context()
+
+		groupId := strings.Trim(strings.TrimPrefix(r.URL.Path, basePath), "/")
+		if groupId == "" {
+			writeAPIError(w, fmt.Errorf("%w: group id required", ErrInvalid))
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+		case "PATCH":
+			var patch GroupPatch
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err = dec.Decode(&patch); err != nil {
+				writeAPIError(w, fmt.Errorf("%w: %v", ErrInvalid, err))
+				return
+			}
+
+			var changing []*Attachment
+			if changing, err = groupMembers(ctx, meta, append(append([]string(nil), patch.Add...), patch.Remove...)); err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			moving := patch.Merge
+			if patch.Name != "" {
+				moving = append(moving, groupId)
+			}
+			for _, g := range moving {
+				var atts []*Attachment
+				if atts, err = cmeta.AttachmentsByGroupIdContext(ctx, g); err != nil {
+					writeAPIError(w, err)
+					return
+				}
+				changing = append(changing, atts...)
+			}
+			if err = Authorize(maker, r, ActionUpload, changing...); err != nil {
+				writeAPIError(w, err)
+				return
+			}
+
+			if err = patch.apply(ctx, meta, groupId); err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			if patch.Name != "" {
+				groupId = patch.Name
+			}
+		default:
+			writeAPIStatus(w, http.StatusMethodNotAllowed, &APIError{"method not allowed"})
+			return
+		}
+
+		group := &APIGroup{GroupStats: GroupStats{GroupId: groupId}}
+		if group.Attachments, err = cmeta.AttachmentsByGroupIdContext(ctx, groupId); err == nil {
+			err = Authorize(maker, r, ActionRead, group.Attachments...)
+		}
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if group.Attachments == nil {
+			group.Attachments = []*Attachment{}
+		}
+		group.Count = len(group.Attachments)
+		for _, att := range group.Attachments {
+			group.Size += att.ContentLength
+		}
+		writeAPIStatus(w, http.StatusOK, group)
+	}
+}
+
+func (p *GroupPatch) apply(ctx context.Context, meta MetaStorage, groupId string) (err error) {
+	if len(p.Merge) > 0 {
+		if _, err = MergeGroupsContext(ctx, meta, groupId, p.Merge...); err != nil {
+			return
+		}
+	}
+	if len(p.Add) > 0 {
+		if _, err = AddToGroupContext(ctx, meta, groupId, p.Add...); err != nil {
+			return
+		}
+	}
+	if len(p.Remove) > 0 {
+		if _, err = RemoveFromGroupContext(ctx, meta, groupId, p.Remove...); err != nil {
+			return
+		}
+	}
+	if p.Name != "" && p.Name != groupId {
+		_, err = RenameGroupContext(ctx, meta, groupId, p.Name)
+	}
+	return
+}
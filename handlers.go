@@ -16,69 +16,180 @@ type Result struct {
 }
 
 func MakeFileLoader(maker StorageMaker) http.HandlerFunc {
+	return makeFileLoader(maker, nil)
+}
+
+// MakeSignedFileLoader is MakeFileLoader that only serves requests signed
+// by signer for the attachment id, download flag and revision of the Input.
+func MakeSignedFileLoader(maker StorageMaker, signer *Signer) http.HandlerFunc {
+	return makeFileLoader(maker, signer)
+}
+
+func makeFileLoader(maker StorageMaker, signer *Signer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		storage, meta, input, err := maker.MakeForRead(r)
+		if err != nil {
+			log.Printf("tenpu: make storage for read error: %v\n", err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
 
 		id, _, download := input.GetViewMeta()
-		if id == "" || err != nil {
-			log.Printf("tenpu: attachment id is blank [%s] or err: %v\n", id, err)
+		if id == "" {
+			log.Printf("tenpu: attachment id is blank\n")
 			http.NotFound(w, r)
 			return
 		}
 
-		att := meta.AttachmentById(id)
-		if att == nil {
+		revision := InputRevision(input)
+		if err = verifySigned(signer, r, []string{id}, "", download, revision); err != nil {
+			log.Printf("tenpu: load attachment [%s] refused: %v\n", id, err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
+		att, err := MetaContext(meta).AttachmentByIdContext(r.Context(), id)
+		if err != nil {
+			log.Printf("tenpu: load attachment by id: [%s] error: %v\n", id, err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+		if att == nil || att.Trashed() {
 			log.Printf("tenpu: attachment can not been fould by id: [%s]\n", id)
 			http.NotFound(w, r)
 			return
 		}
 
+		if revision > 0 {
+			if att = att.AtRevision(revision); att == nil {
+				log.Printf("tenpu: attachment [%s] has no revision %d\n", id, revision)
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		action := ActionRead
+		if download {
+			action = ActionDownload
+		}
+		if err = Authorize(maker, r, action, att); err != nil {
+			log.Printf("tenpu: %s attachment [%s] refused: %v\n", action, id, err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
 		// log.Printf("Load file id:%s, name:%s, size:%.2f M", id, att.Filename, float32(att.ContentLength)/1024/1024)
+		disposition := DispositionInline
 		if download {
-			filename, _, _ := input.GetFileMeta()
-			w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+			disposition = DispositionAttachment
 		}
+		w.Header().Set("Content-Disposition", ContentDisposition(disposition, att.Filename))
 
 		w.Header().Set("Content-Type", att.ContentType)
 		// fix pdf Content-Type
 		if strings.ToLower(att.Extname()) == "pdf" {
 			w.Header().Set("Content-Type", "application/pdf")
 		}
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", att.ContentLength))
 		SetCacheControl(w, 30)
-		err = storage.Copy(att, w)
+		SetValidators(w, att)
+
+		if NotModified(w, r) {
+			return
+		}
+
+		if r.Method == "HEAD" {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", att.ContentLength))
+			return
+		}
 
+		f, err := BlobContext(storage).OpenContext(r.Context(), att)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("tenpu: open attachment body by id: [%s] error: %v\n", id, err)
+			http.Error(w, err.Error(), StatusCode(err))
 			return
 		}
+		defer f.Close()
 
+		// ServeContent answers Range and If-Range requests with 206 partial
+		// content, multiple ranges as multipart/byteranges.
+		http.ServeContent(w, r, att.Filename, att.UploadTime, f)
 		return
 	}
 }
 
 func MakeZipFileLoader(maker StorageMaker) http.HandlerFunc {
+	return makeZipFileLoader(maker, nil)
+}
+
+// MakeSignedZipFileLoader is MakeZipFileLoader that only serves requests
+// signed by signer for the ids of the attachments the Input loads.
+func MakeSignedZipFileLoader(maker StorageMaker, signer *Signer) http.HandlerFunc {
+	return makeZipFileLoader(maker, signer)
+}
+
+func makeZipFileLoader(maker StorageMaker, signer *Signer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		storage, _, input, err := maker.MakeForRead(r)
-		var atts []*Attachment
-		atts, err = input.LoadAttachments()
+		if err != nil {
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
+		atts, err := input.LoadAttachments()
+		if err != nil {
+			log.Printf("tenpu: load attachments for zip error: %v\n", err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
+		var ids []string
+		for _, att := range atts {
+			ids = append(ids, att.Id)
+		}
+		if err = verifySigned(signer, r, ids, "", false, 0); err != nil {
+			log.Printf("tenpu: load zip of %v refused: %v\n", ids, err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
+		atts = withoutTrashed(atts)
 
 		if atts == nil {
 			http.NotFound(w, r)
 			return
 		}
-		// w.Header().Set("Content-Type", "application/zip")
-		// w.Header().Set("Content-Length", fmt.Sprintf("%d", att.ContentLength))
-		// w.Header().Set("Expires", formatDays(30))
-		// w.Header().Set("Cache-Control", "max-age="+formatDayToSec(30))
 
-		err = storage.Zip(atts, w)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err = Authorize(maker, r, ActionDownload, atts...); err != nil {
+			log.Printf("tenpu: load zip of %v refused: %v\n", ids, err)
+			http.Error(w, err.Error(), StatusCode(err))
 			return
 		}
+		writeZip(w, r, storage, input, atts, ZipFilename)
+	}
+}
 
-		return
+// writeZip sends atts as a zip download named filename, unless input is a
+// ZipNameInput, laid out by the ZipBuilder of input if it is a
+// ZipBuilderInput.
+func writeZip(w http.ResponseWriter, r *http.Request, storage BlobStorage, input Input, atts []*Attachment, filename string) {
+	if zi, ok := input.(ZipNameInput); ok && zi.GetZipName() != "" {
+		filename = zi.GetZipName()
+	}
+	builder := DefaultZipBuilder
+	if bi, ok := input.(ZipBuilderInput); ok && bi.GetZipBuilder() != nil {
+		builder = bi.GetZipBuilder()
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", ContentDisposition(DispositionAttachment, filename))
+	// w.Header().Set("Content-Length", fmt.Sprintf("%d", att.ContentLength))
+	// w.Header().Set("Expires", formatDays(30))
+	// w.Header().Set("Cache-Control", "max-age="+formatDayToSec(30))
+
+	// the status is sent with the first entry, a failure after it can only
+	// cut the zip short
+	if err := builder.Write(r.Context(), storage, atts, w); err != nil {
+		log.Printf("tenpu: write zip error: %v\n", err)
 	}
 }
 
@@ -86,11 +197,21 @@ func MakeDeleter(maker StorageMaker) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		blob, meta, input, err := maker.MakeForRead(r)
+		if err != nil {
+			writeError(w, err, nil)
+			return
+		}
 
-		att, deleted, err := DeleteAttachment(input, blob, meta)
+		id, _, _ := input.GetViewMeta()
+		if err = authorizeId(maker, r, meta, id, ActionDelete); err != nil {
+			writeError(w, err, nil)
+			return
+		}
+
+		att, deleted, err := DeleteAttachmentContext(r.Context(), input, blob, meta)
 
 		if err != nil {
-			writeJson(w, err.Error(), []*Attachment{att})
+			writeError(w, err, []*Attachment{att})
 			return
 		}
 
@@ -108,19 +229,20 @@ func MakeUploader(maker StorageMaker) http.HandlerFunc {
 
 		blob, meta, input, err1 := maker.MakeForUpload(r)
 		if err1 != nil {
-			writeJson(w, err1.Error(), nil)
+			writeError(w, err1, nil)
 			return
 		}
 
 		mr, err := r.MultipartReader()
 
 		if err != nil {
-			writeJson(w, err.Error(), nil)
+			writeError(w, fmt.Errorf("%w: %v", ErrInvalid, err), nil)
 			return
 		}
 
 		var part *multipart.Part
 		var attachments []*Attachment
+		var firstErr error
 
 		for {
 			part, err = mr.NextPart()
@@ -134,16 +256,40 @@ func MakeUploader(maker StorageMaker) http.HandlerFunc {
 			}
 
 			var att *Attachment
-			att, err = CreateAttachment(input, blob, meta, part)
+			if err = authorizeCreate(maker, r, input); err == nil {
+				att, err = CreateAttachmentContext(r.Context(), input, blob, meta, part)
+			}
 			if err != nil {
-				att.Error = err.Error()
+				// the attachment was rolled back, only report which file
+				// failed and why
+				log.Printf("tenpu: upload file name:%s error: %v\n", part.FileName(), err)
+				attachments = append(attachments, &Attachment{
+					Filename:    part.FileName(),
+					ContentType: part.Header.Get("Content-Type"),
+					Error:       err.Error(),
+				})
+				if firstErr == nil {
+					firstErr = err
+				}
+				if r.Context().Err() != nil {
+					break
+				}
+				continue
 			}
 			log.Printf("Upload file id:%s, name:%s, size:%.2f M", att.Id, att.Filename, float32(att.ContentLength)/1024/1024)
+			postUpload(maker, r, blob, meta, att)
 			attachments = append(attachments, att)
 		}
 
 		if len(attachments) == 0 {
-			writeJson(w, "No attachments uploaded.", nil)
+			writeError(w, fmt.Errorf("%w: no attachments uploaded", ErrInvalid), nil)
+			return
+		}
+
+		// only fail the request when no file made it, the others report
+		// their own Error
+		if firstErr != nil && len(attachments) == countFailed(attachments) {
+			writeError(w, firstErr, attachments)
 			return
 		}
 
@@ -157,17 +303,123 @@ func SetCacheControl(w http.ResponseWriter, days int) {
 	w.Header().Set("Cache-Control", "max-age="+formatDayToSec(days))
 }
 
+// authorizeId authorizes action on the attachment of id. An unknown id
+// passes, for the operation itself to report it.
+func authorizeId(maker StorageMaker, r *http.Request, meta MetaStorage, id string, action Action) (err error) {
+	if _, ok := maker.(Authorizer); !ok || id == "" {
+		return
+	}
+	att, err := MetaContext(meta).AttachmentByIdContext(r.Context(), id)
+	if err != nil || att == nil {
+		return
+	}
+	err = Authorize(maker, r, action, att)
+	return
+}
+
+func withoutTrashed(atts []*Attachment) (r []*Attachment) {
+	for _, att := range atts {
+		if !att.Trashed() {
+			r = append(r, att)
+		}
+	}
+	return
+}
+
+func countFailed(attachments []*Attachment) (r int) {
+	for _, att := range attachments {
+		if att.Error != "" {
+			r++
+		}
+	}
+	return
+}
+
 func writeJson(w http.ResponseWriter, err string, attachments []*Attachment) {
+	writeJsonStatus(w, http.StatusOK, err, attachments)
+}
+
+func writeError(w http.ResponseWriter, err error, attachments []*Attachment) {
+	writeJsonStatus(w, StatusCode(err), err.Error(), attachments)
+}
+
+func writeJsonStatus(w http.ResponseWriter, status int, err string, attachments []*Attachment) {
 	r := &Result{
 		Error:       err,
 		Attachments: attachments,
 	}
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	// w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	b, _ := json.Marshal(r)
+	w.WriteHeader(status)
 	w.Write(b)
 }
 
+// SetValidators sets the ETag from the MD5 and the Last-Modified from the
+// UploadTime of att, for conditional requests.
+func SetValidators(w http.ResponseWriter, att *Attachment) {
+	if att.MD5 != "" {
+		w.Header().Set("ETag", `"`+att.MD5+`"`)
+	}
+	if !att.UploadTime.IsZero() {
+		w.Header().Set("Last-Modified", att.UploadTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// NotModified checks If-None-Match and If-Modified-Since against the
+// validators already set on w. It writes a 304 and returns true when the
+// client copy is still good.
+func NotModified(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := w.Header().Get("ETag")
+		if etag == "" || !etagMatch(inm, etag) {
+			return false
+		}
+		writeNotModified(w)
+		return true
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	lm := w.Header().Get("Last-Modified")
+	if ims == "" || lm == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lm)
+	if err != nil || modified.After(since) {
+		return false
+	}
+	writeNotModified(w)
+	return true
+}
+
+// etagMatch is the weak comparison of If-None-Match.
+func etagMatch(header string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Disposition")
+	w.WriteHeader(http.StatusNotModified)
+}
+
 // the time format used for HTTP headers
 const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 
@@ -0,0 +1,175 @@
+package localfs
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/theplant/tenpu"
+	_ "golang.org/x/image/bmp"
+)
+
+// Storage keeps attachment bodies as plain files under root, sharded into
+// two levels of sub directories by the first four characters of the id.
+type Storage struct {
+	root string
+}
+
+func NewStorage(root string) (s *Storage) {
+	s = &Storage{}
+	if root == "" {
+		root = "attachments"
+	}
+	s.root = root
+	return
+}
+
+func (s *Storage) Put(filename string, contentType string, body io.Reader, attachment *tenpu.Attachment) (err error) {
+	id := attachment.BodyId()
+	if id == "" {
+		id, err = tenpu.NewId()
+		if err != nil {
+			return
+		}
+	}
+	if !validId(id) {
+		err = fmt.Errorf("%w: tenpu/localfs: attachment id %s", tenpu.ErrInvalid, id)
+		return
+	}
+
+	path := s.path(id)
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return
+	}
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	if attachment.Id == "" {
+		attachment.Id = id
+		attachment.ContentLength = size
+		attachment.ContentType = contentType
+		attachment.Filename = filename
+		attachment.MD5 = hex.EncodeToString(hash.Sum(nil))
+		if attachment.IsImage() {
+			s.decodeImageSize(attachment)
+		}
+	}
+
+	return
+}
+
+func (s *Storage) Open(attachment *tenpu.Attachment) (r io.ReadSeekCloser, err error) {
+	f, err := s.open(attachment.BodyId())
+	if err != nil {
+		return
+	}
+	r = f
+	return
+}
+
+func (s *Storage) CopyToStorage(attachment *tenpu.Attachment, toBlob tenpu.BlobStorage) (err error) {
+	f, err := s.open(attachment.BodyId())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = toBlob.Put(attachment.Filename, attachment.ContentType, f, attachment)
+	return
+}
+
+func (s *Storage) Copy(attachment *tenpu.Attachment, w io.Writer) (err error) {
+	f, err := s.open(attachment.BodyId())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return
+}
+
+func (s *Storage) Zip(attachments []*tenpu.Attachment, w io.Writer) (err error) {
+	return tenpu.WriteZip(s, attachments, w)
+}
+
+func (s *Storage) Delete(attachmentId string) (err error) {
+	if !validId(attachmentId) {
+		err = tenpu.ErrNotFound
+		return
+	}
+	err = os.Remove(s.path(attachmentId))
+	if os.IsNotExist(err) {
+		err = tenpu.ErrNotFound
+	}
+	return
+}
+
+func (s *Storage) path(id string) string {
+	return filepath.Join(s.root, id[0:2], id[2:4], id)
+}
+
+func (s *Storage) open(id string) (f *os.File, err error) {
+	if !validId(id) {
+		err = tenpu.ErrNotFound
+		return
+	}
+	f, err = os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		err = tenpu.ErrNotFound
+	}
+	return
+}
+
+func (s *Storage) decodeImageSize(attachment *tenpu.Attachment) {
+	f, err := s.open(attachment.BodyId())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err == nil {
+		attachment.Width = config.Width
+		attachment.Height = config.Height
+	}
+}
+
+// validId keeps ids from escaping root, ids end up as file names.
+func validId(id string) bool {
+	if len(id) < 4 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,213 @@
+package localfs
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/theplant/tenpu"
+)
+
+// UploadStore keeps resumable uploads in dir, the data of each in <id>.bin
+// and its description in <id>.json.
+type UploadStore struct {
+	dir   string
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewUploadStore(dir string) (s *UploadStore) {
+	s = &UploadStore{}
+	if dir == "" {
+		dir = "uploads"
+	}
+	s.dir = dir
+	s.locks = make(map[string]*sync.Mutex)
+	return
+}
+
+func (s *UploadStore) Create(upload *tenpu.Upload) (err error) {
+	if err = os.MkdirAll(s.dir, 0755); err != nil {
+		return
+	}
+
+	upload.Id, err = tenpu.NewId()
+	if err != nil {
+		return
+	}
+
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(s.path(upload.Id, ".bin"), nil, 0644); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(s.path(upload.Id, ".json"), b, 0644)
+	return
+}
+
+func (s *UploadStore) Upload(id string) (upload *tenpu.Upload, err error) {
+	if !validId(id) {
+		return
+	}
+
+	b, err := ioutil.ReadFile(s.path(id, ".json"))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	upload = &tenpu.Upload{}
+	if err = json.Unmarshal(b, upload); err != nil {
+		return
+	}
+
+	fi, err := os.Stat(s.path(id, ".bin"))
+	if err != nil {
+		return
+	}
+	upload.Offset = fi.Size()
+	return
+}
+
+func (s *UploadStore) Uploads() (r []*tenpu.Upload, err error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		var upload *tenpu.Upload
+		upload, err = s.Upload(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			return
+		}
+		// removed since the glob
+		if upload != nil {
+			r = append(r, upload)
+		}
+	}
+	return
+}
+
+func (s *UploadStore) Append(id string, offset int64, body io.Reader) (n int64, err error) {
+	lock := s.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, err := s.Upload(id)
+	if err != nil {
+		return
+	}
+	if upload == nil {
+		err = tenpu.ErrNotFound
+		return
+	}
+	if upload.Offset != offset {
+		err = tenpu.ErrUploadOffset
+		return
+	}
+
+	f, err := os.OpenFile(s.path(id, ".bin"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	n, err = io.Copy(f, io.LimitReader(body, upload.Length-offset))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+func (s *UploadStore) Open(id string) (r io.ReadCloser, err error) {
+	if !validId(id) {
+		err = tenpu.ErrNotFound
+		return
+	}
+	r, err = os.Open(s.path(id, ".bin"))
+	return
+}
+
+// Claim removes the description of the upload first, only one remove of a
+// file succeeds, and then gives its data, removed when r is closed.
+func (s *UploadStore) Claim(id string) (r io.ReadCloser, err error) {
+	if !validId(id) {
+		err = tenpu.ErrNotFound
+		return
+	}
+	lock := s.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err = os.Remove(s.path(id, ".json")); os.IsNotExist(err) {
+		err = tenpu.ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	s.dropLock(id)
+
+	f, err := os.Open(s.path(id, ".bin"))
+	if err != nil {
+		return
+	}
+	r = &claimedFile{f}
+	return
+}
+
+func (s *UploadStore) Remove(id string) (err error) {
+	if !validId(id) {
+		err = tenpu.ErrNotFound
+		return
+	}
+	os.Remove(s.path(id, ".bin"))
+	if err = os.Remove(s.path(id, ".json")); os.IsNotExist(err) {
+		err = tenpu.ErrNotFound
+	}
+	s.dropLock(id)
+	return
+}
+
+// claimedFile is the data of a claimed upload, removed once read.
+type claimedFile struct {
+	*os.File
+}
+
+func (f *claimedFile) Close() (err error) {
+	err = f.File.Close()
+	os.Remove(f.Name())
+	return
+}
+
+// lock gives the mutex serializing appends to the upload of id.
+func (s *UploadStore) lock(id string) *sync.Mutex {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l, ok := s.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	return l
+}
+
+// dropLock drops the mutex of the upload of id once it is gone.
+func (s *UploadStore) dropLock(id string) {
+	s.mutex.Lock()
+	delete(s.locks, id)
+	s.mutex.Unlock()
+}
+
+func (s *UploadStore) path(id string, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
@@ -0,0 +1,328 @@
+// Package memstore keeps attachment bodies and meta in process memory.
+// It is meant for tests and for embedding tenpu where nothing needs to
+// survive a restart. Both storages are safe for concurrent use.
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/theplant/tenpu"
+	_ "golang.org/x/image/bmp"
+)
+
+type BlobStorage struct {
+	mutex  sync.RWMutex
+	bodies map[string][]byte
+}
+
+func NewBlobStorage() (s *BlobStorage) {
+	s = &BlobStorage{}
+	s.bodies = make(map[string][]byte)
+	return
+}
+
+func (s *BlobStorage) Put(filename string, contentType string, body io.Reader, attachment *tenpu.Attachment) (err error) {
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, body); err != nil {
+		return
+	}
+
+	id := attachment.BodyId()
+	if id == "" {
+		id, err = tenpu.NewId()
+		if err != nil {
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	s.bodies[id] = buf.Bytes()
+	s.mutex.Unlock()
+
+	if attachment.Id == "" {
+		sum := md5.Sum(buf.Bytes())
+		attachment.Id = id
+		attachment.ContentLength = int64(buf.Len())
+		attachment.ContentType = contentType
+		attachment.Filename = filename
+		attachment.MD5 = hex.EncodeToString(sum[:])
+		if attachment.IsImage() {
+			config, _, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+			if err == nil {
+				attachment.Width = config.Width
+				attachment.Height = config.Height
+			}
+		}
+	}
+	return
+}
+
+type bodyReader struct {
+	*bytes.Reader
+}
+
+func (r *bodyReader) Close() error {
+	return nil
+}
+
+func (s *BlobStorage) Open(attachment *tenpu.Attachment) (r io.ReadSeekCloser, err error) {
+	body, err := s.body(attachment.BodyId())
+	if err != nil {
+		return
+	}
+	r = &bodyReader{bytes.NewReader(body)}
+	return
+}
+
+func (s *BlobStorage) CopyToStorage(attachment *tenpu.Attachment, toBlob tenpu.BlobStorage) (err error) {
+	body, err := s.body(attachment.BodyId())
+	if err != nil {
+		return
+	}
+	err = toBlob.Put(attachment.Filename, attachment.ContentType, bytes.NewReader(body), attachment)
+	return
+}
+
+func (s *BlobStorage) Copy(attachment *tenpu.Attachment, w io.Writer) (err error) {
+	body, err := s.body(attachment.BodyId())
+	if err != nil {
+		return
+	}
+	_, err = w.Write(body)
+	return
+}
+
+func (s *BlobStorage) Zip(attachments []*tenpu.Attachment, w io.Writer) (err error) {
+	return tenpu.WriteZip(s, attachments, w)
+}
+
+func (s *BlobStorage) Delete(attachmentId string) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.bodies[attachmentId]; !ok {
+		err = tenpu.ErrNotFound
+		return
+	}
+	delete(s.bodies, attachmentId)
+	return
+}
+
+func (s *BlobStorage) body(id string) (body []byte, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	body, ok := s.bodies[id]
+	if !ok {
+		err = tenpu.ErrNotFound
+	}
+	return
+}
+
+// MetaStorage hands out copies of the stored attachments, like a database
+// would, so callers changing a result do not change what is stored until
+// they Put it back.
+type MetaStorage struct {
+	mutex       sync.RWMutex
+	ids         []string
+	attachments map[string]*tenpu.Attachment
+}
+
+func NewMetaStorage() (s *MetaStorage) {
+	s = &MetaStorage{}
+	s.attachments = make(map[string]*tenpu.Attachment)
+	return
+}
+
+func (s *MetaStorage) Put(att *tenpu.Attachment) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.attachments[att.Id]; !ok {
+		s.ids = append(s.ids, att.Id)
+	}
+	s.attachments[att.Id] = copyAttachment(att)
+	return
+}
+
+func (s *MetaStorage) SwapRevision(ctx context.Context, att *tenpu.Attachment, revision int) (swapped bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, ok := s.attachments[att.Id]
+	if !ok || stored.Revision != revision {
+		return
+	}
+	s.attachments[att.Id] = copyAttachment(att)
+	swapped = true
+	return
+}
+
+func (s *MetaStorage) Remove(id string) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.attachments[id]; !ok {
+		return
+	}
+	delete(s.attachments, id)
+	for i, sid := range s.ids {
+		if sid == id {
+			s.ids = append(s.ids[:i], s.ids[i+1:]...)
+			break
+		}
+	}
+	return
+}
+
+func (s *MetaStorage) Attachments(ownerid string) (r []*tenpu.Attachment, err error) {
+	r = s.filter(func(att *tenpu.Attachment) bool {
+		return !att.Trashed() && contains(att.OwnerId, ownerid)
+	})
+	return
+}
+
+func (s *MetaStorage) AttachmentsByOwnerIds(ownerids []string) (r []*tenpu.Attachment, err error) {
+	r = s.filter(func(att *tenpu.Attachment) bool {
+		return !att.Trashed() && containsAny(att.OwnerId, ownerids)
+	})
+	return
+}
+
+func (s *MetaStorage) AttachmentsCountByOwnerIds(ownerids []string) (r int, err error) {
+	atts, err := s.AttachmentsByOwnerIds(ownerids)
+	r = len(atts)
+	return
+}
+
+func (s *MetaStorage) AttachmentById(id string) (r *tenpu.Attachment, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if att, ok := s.attachments[id]; ok {
+		r = copyAttachment(att)
+	}
+	return
+}
+
+func (s *MetaStorage) AttachmentByIds(ids []string) (r []*tenpu.Attachment, err error) {
+	r = s.filter(func(att *tenpu.Attachment) bool {
+		return !att.Trashed() && contains(ids, att.Id)
+	})
+	return
+}
+
+func (s *MetaStorage) AttachmentsByGroupId(groupId string) (r []*tenpu.Attachment, err error) {
+	r = s.filter(func(att *tenpu.Attachment) bool {
+		return !att.Trashed() && contains(att.GroupId, groupId)
+	})
+	return
+}
+
+func (s *MetaStorage) AttachmentByContent(sha256 string, contentLength int64) (r *tenpu.Attachment, err error) {
+	atts := s.filter(func(att *tenpu.Attachment) bool {
+		return att.SHA256 == sha256 && att.ContentLength == contentLength && !att.Trashed()
+	})
+	if len(atts) > 0 {
+		r = atts[0]
+	}
+	return
+}
+
+func (s *MetaStorage) AttachmentsCountByBlobId(blobId string) (r int, err error) {
+	r = len(s.filter(func(att *tenpu.Attachment) bool {
+		return contains(att.BlobIds(), blobId)
+	}))
+	return
+}
+
+func (s *MetaStorage) TrashedAttachments(deletedBefore time.Time) (r []*tenpu.Attachment, err error) {
+	r = s.filter(func(att *tenpu.Attachment) bool {
+		return att.Trashed() && att.DeletedAt.Before(deletedBefore)
+	})
+	return
+}
+
+func (s *MetaStorage) QueryAttachments(q *tenpu.Query) (page *tenpu.Page, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+	cursor, err := q.ParseCursor()
+	if err != nil {
+		return
+	}
+
+	atts := s.filter(func(att *tenpu.Attachment) bool {
+		return q.Match(att) && q.After(cursor, att)
+	})
+	sort.Slice(atts, func(i, j int) bool {
+		return q.Less(atts[i], atts[j])
+	})
+	if len(atts) > q.Limit+1 {
+		atts = atts[:q.Limit+1]
+	}
+	page, err = tenpu.NewPage(q, atts)
+	return
+}
+
+func (s *MetaStorage) filter(match func(att *tenpu.Attachment) bool) (r []*tenpu.Attachment) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, id := range s.ids {
+		att := s.attachments[id]
+		if match(att) {
+			r = append(r, copyAttachment(att))
+		}
+	}
+	return
+}
+
+func copyAttachment(att *tenpu.Attachment) (r *tenpu.Attachment) {
+	c := *att
+	c.OwnerId = append([]string(nil), att.OwnerId...)
+	c.GroupId = append([]string(nil), att.GroupId...)
+	c.Tags = append([]string(nil), att.Tags...)
+	if att.Attrs != nil {
+		c.Attrs = make(map[string]string, len(att.Attrs))
+		for name, v := range att.Attrs {
+			c.Attrs[name] = v
+		}
+	}
+	c.Revisions = nil
+	for _, rev := range att.Revisions {
+		crev := *rev
+		c.Revisions = append(c.Revisions, &crev)
+	}
+	r = &c
+	return
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values []string, vs []string) bool {
+	for _, v := range vs {
+		if contains(values, v) {
+			return true
+		}
+	}
+	return false
+}
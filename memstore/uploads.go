@@ -0,0 +1,131 @@
+package memstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/theplant/tenpu"
+)
+
+type upload struct {
+	info tenpu.Upload
+	data []byte
+}
+
+// UploadStore keeps resumable uploads in memory.
+type UploadStore struct {
+	mutex   sync.Mutex
+	uploads map[string]*upload
+}
+
+func NewUploadStore() (s *UploadStore) {
+	s = &UploadStore{}
+	s.uploads = make(map[string]*upload)
+	return
+}
+
+func (s *UploadStore) Create(u *tenpu.Upload) (err error) {
+	u.Id, err = tenpu.NewId()
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.uploads[u.Id] = &upload{info: *u}
+	s.mutex.Unlock()
+	return
+}
+
+func (s *UploadStore) Upload(id string) (r *tenpu.Upload, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		return
+	}
+	info := u.info
+	info.Offset = int64(len(u.data))
+	r = &info
+	return
+}
+
+func (s *UploadStore) Uploads() (r []*tenpu.Upload, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, u := range s.uploads {
+		info := u.info
+		info.Offset = int64(len(u.data))
+		r = append(r, &info)
+	}
+	return
+}
+
+func (s *UploadStore) Append(id string, offset int64, body io.Reader) (n int64, err error) {
+	r, err := s.Upload(id)
+	if err != nil {
+		return
+	}
+	if r == nil {
+		err = tenpu.ErrNotFound
+		return
+	}
+	if r.Offset != offset {
+		err = tenpu.ErrUploadOffset
+		return
+	}
+
+	// read the body without holding the lock, and check the offset again
+	// before keeping it
+	var buf bytes.Buffer
+	n, err = io.Copy(&buf, io.LimitReader(body, r.Length-offset))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok || int64(len(u.data)) != offset {
+		n = 0
+		err = tenpu.ErrUploadOffset
+		return
+	}
+	u.data = append(u.data, buf.Bytes()...)
+	return
+}
+
+func (s *UploadStore) Open(id string) (r io.ReadCloser, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		err = tenpu.ErrNotFound
+		return
+	}
+	r = ioutil.NopCloser(bytes.NewReader(u.data))
+	return
+}
+
+func (s *UploadStore) Claim(id string) (r io.ReadCloser, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		err = tenpu.ErrNotFound
+		return
+	}
+	delete(s.uploads, id)
+	r = ioutil.NopCloser(bytes.NewReader(u.data))
+	return
+}
+
+func (s *UploadStore) Remove(id string) (err error) {
+	s.mutex.Lock()
+	delete(s.uploads, id)
+	s.mutex.Unlock()
+	return
+}
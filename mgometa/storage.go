@@ -1,10 +1,13 @@
 package mgometa
 
 import (
+	"context"
 	"github.com/theplant/mgodb"
 	"github.com/theplant/tenpu"
 	mgo "gopkg.in/mgo.v2"
 	"labix.org/v2/mgo/bson"
+	"regexp"
+	"time"
 )
 
 type Storage struct {
@@ -27,56 +30,335 @@ func NewStorage(db *mgodb.Database, collectionName string) (s *Storage) {
 	return
 }
 
+// document is how an attachment is stored, with the attribute values in
+// a field of their own for the text index, which can not index the values
+// of a map by itself.
+type document struct {
+	tenpu.Attachment `bson:",inline"`
+	AttrValues       []string `bson:"attrvalues,omitempty"`
+}
+
 func (s *Storage) Put(att *tenpu.Attachment) (err error) {
-	err = s.database.Save(s.collectionName, att)
+	doc := &document{Attachment: *att}
+	for _, v := range att.Attrs {
+		doc.AttrValues = append(doc.AttrValues, v)
+	}
+	err = s.database.Save(s.collectionName, doc)
+	return
+}
+
+func (s *Storage) SwapRevision(ctx context.Context, att *tenpu.Attachment, revision int) (swapped bool, err error) {
+	doc := &document{Attachment: *att}
+	for _, v := range att.Attrs {
+		doc.AttrValues = append(doc.AttrValues, v)
+	}
+	var stored interface{} = revision
+	if revision == 0 {
+		// stored before revisions
+		stored = bson.M{"$in": []interface{}{nil, 0}}
+	}
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		err = c.Update(bson.M{"_id": att.Id, "revision": stored}, doc)
+	})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	swapped = err == nil
+	return
+}
+
+func (s *Storage) Attachments(ownerid string) (r []*tenpu.Attachment, err error) {
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		err = c.Find(live(bson.M{"ownerid": ownerid})).All(&r)
+	})
+	return
+}
+
+func (s *Storage) AttachmentsByOwnerIds(ownerids []string) (r []*tenpu.Attachment, err error) {
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		err = c.Find(live(bson.M{"ownerid": bson.M{"$in": ownerids}})).All(&r)
+	})
+	return
+}
+
+func (s *Storage) AttachmentsCountByOwnerIds(ownerids []string) (r int, err error) {
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		r, err = c.Find(live(bson.M{"ownerid": bson.M{"$in": ownerids}})).Count()
+	})
 	return
 }
 
-func (s *Storage) Attachments(ownerid string) (r []*tenpu.Attachment) {
+func (s *Storage) AttachmentById(id string) (r *tenpu.Attachment, err error) {
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		c.Find(bson.M{"ownerid": ownerid}).All(&r)
+		err = c.Find(bson.M{"_id": id}).One(&r)
 	})
+	r, err = one(r, err)
 	return
 }
 
-func (s *Storage) AttachmentsByOwnerIds(ownerids []string) (r []*tenpu.Attachment) {
+func (s *Storage) AttachmentByIds(ids []string) (r []*tenpu.Attachment, err error) {
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		c.Find(bson.M{"ownerid": bson.M{"$in": ownerids}}).All(&r)
+		err = c.Find(live(bson.M{"_id": bson.M{"$in": ids}})).All(&r)
 	})
 	return
 }
 
-func (s *Storage) AttachmentsCountByOwnerIds(ownerids []string) (r int) {
+func (s *Storage) AttachmentsByGroupId(groupId string) (r []*tenpu.Attachment, err error) {
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		r, _ = c.Find(bson.M{"ownerid": bson.M{"$in": ownerids}}).Count()
+		err = c.Find(live(bson.M{"groupid": groupId})).All(&r)
 	})
 	return
 }
 
-func (s *Storage) AttachmentById(id string) (r *tenpu.Attachment) {
+func (s *Storage) GroupStats(groupIds []string) (r []*tenpu.GroupStats, err error) {
+	var totals []struct {
+		GroupId string `bson:"_id"`
+		Count   int
+		Size    int64
+	}
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		err = c.Pipe([]bson.M{
+			{"$match": live(bson.M{"groupid": bson.M{"$in": groupIds}})},
+			{"$unwind": "$groupid"},
+			{"$match": bson.M{"groupid": bson.M{"$in": groupIds}}},
+			{"$group": bson.M{
+				"_id":   "$groupid",
+				"count": bson.M{"$sum": 1},
+				"size":  bson.M{"$sum": "$contentlength"},
+			}},
+		}).All(&totals)
+	})
+	if err != nil {
+		return
+	}
+
+	byId := map[string]*tenpu.GroupStats{}
+	for _, groupId := range groupIds {
+		stats := &tenpu.GroupStats{GroupId: groupId}
+		byId[groupId] = stats
+		r = append(r, stats)
+	}
+	for _, t := range totals {
+		if stats, ok := byId[t.GroupId]; ok {
+			stats.Count, stats.Size = t.Count, t.Size
+		}
+	}
+	return
+}
+
+func (s *Storage) AttachmentByContent(sha256 string, contentLength int64) (r *tenpu.Attachment, err error) {
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		c.Find(bson.M{"_id": id}).One(&r)
+		err = c.Find(live(bson.M{"sha256": sha256, "contentlength": contentLength})).One(&r)
 	})
+	r, err = one(r, err)
 	return
 }
 
-func (s *Storage) AttachmentByIds(ids []string) (r []*tenpu.Attachment) {
+func (s *Storage) AttachmentsCountByBlobId(blobId string) (r int, err error) {
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&r)
+		r, err = c.Find(bson.M{"$or": []bson.M{
+			{"blobid": blobId},
+			{"_id": blobId, "blobid": bson.M{"$in": []interface{}{nil, ""}}},
+			{"revisions.blobid": blobId},
+		}}).Count()
 	})
 	return
 }
 
-func (s *Storage) AttachmentsByGroupId(groupId string) (r *tenpu.Attachment) {
+func (s *Storage) TrashedAttachments(deletedBefore time.Time) (r []*tenpu.Attachment, err error) {
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		c.Find(bson.M{"groupid": groupId}).All(&r)
+		err = c.Find(bson.M{"deletedat": bson.M{"$gt": time.Time{}, "$lt": deletedBefore}}).All(&r)
 	})
 	return
 }
 
 func (s *Storage) Remove(id string) (err error) {
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		c.Remove(bson.M{"_id": id})
+		err = c.Remove(bson.M{"_id": id})
 	})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
 	return
 }
+
+// QueryAttachments pages through the attachments by q, see EnsureIndexes
+// for the indexes it needs.
+func (s *Storage) QueryAttachments(q *tenpu.Query) (page *tenpu.Page, err error) {
+	if err = q.Validate(); err != nil {
+		return
+	}
+	cursor, err := q.ParseCursor()
+	if err != nil {
+		return
+	}
+
+	query := live(bson.M{})
+	if len(q.OwnerIds) > 0 {
+		query["ownerid"] = bson.M{"$in": q.OwnerIds}
+	}
+	if q.GroupId != "" {
+		query["groupid"] = q.GroupId
+	}
+	if q.Category != "" {
+		query["category"] = q.Category
+	}
+	if q.ContentTypePrefix != "" {
+		query["contenttype"] = bson.M{"$regex": "^" + regexp.QuoteMeta(q.ContentTypePrefix)}
+	}
+	uploadTime := bson.M{}
+	if !q.UploadedAfter.IsZero() {
+		uploadTime["$gte"] = q.UploadedAfter
+	}
+	if !q.UploadedBefore.IsZero() {
+		uploadTime["$lt"] = q.UploadedBefore
+	}
+	if len(uploadTime) > 0 {
+		query["uploadtime"] = uploadTime
+	}
+	size := bson.M{}
+	if q.MinSize > 0 {
+		size["$gte"] = q.MinSize
+	}
+	if q.MaxSize > 0 {
+		size["$lte"] = q.MaxSize
+	}
+	if len(size) > 0 {
+		query["contentlength"] = size
+	}
+	if len(q.Tags) > 0 {
+		query["tags"] = bson.M{"$all": q.Tags}
+	}
+	for name, v := range q.Attrs {
+		query["attrs."+name] = v
+	}
+
+	field, op, order := "uploadtime", "$gt", ""
+	if q.Descending {
+		op, order = "$lt", "-"
+	}
+	switch q.Sort {
+	case tenpu.SortByName:
+		field = "filename"
+	case tenpu.SortBySize:
+		field = "contentlength"
+	}
+	if cursor != nil {
+		var value interface{} = cursor.UploadTime
+		switch q.Sort {
+		case tenpu.SortByName:
+			value = cursor.Filename
+		case tenpu.SortBySize:
+			value = cursor.ContentLength
+		}
+		// the cursor condition goes with the other ones in an $and, so it
+		// does not replace a range on the same field
+		query = bson.M{"$and": []bson.M{query, {"$or": []bson.M{
+			{field: bson.M{op: value}},
+			{field: value, "_id": bson.M{op: cursor.Id}},
+		}}}}
+	}
+
+	var atts []*tenpu.Attachment
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		err = c.Find(query).Sort(order+field, order+"_id").Limit(q.Limit + 1).All(&atts)
+	})
+	if err != nil {
+		return
+	}
+	page, err = tenpu.NewPage(q, atts)
+	return
+}
+
+// SearchAttachments finds attachments with the text index of EnsureIndexes.
+// It matches whole words, and ranks the hits by the text score, which
+// weighs the fields like the naive search of tenpu.SearchAttachments.
+func (s *Storage) SearchAttachments(search *tenpu.Search) (r *tenpu.SearchResult, err error) {
+	if err = search.Validate(); err != nil {
+		return
+	}
+	offset, err := search.Offset()
+	if err != nil {
+		return
+	}
+
+	var found []struct {
+		tenpu.Attachment `bson:",inline"`
+		Score            float64 `bson:"score"`
+	}
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		err = c.Find(live(bson.M{
+			"$text":   bson.M{"$search": search.Text},
+			"ownerid": bson.M{"$in": search.OwnerIds},
+		})).Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+			Sort("$textScore:score", "-uploadtime", "_id").
+			Skip(offset).Limit(search.Limit + 1).All(&found)
+	})
+	if err != nil {
+		return
+	}
+
+	var hits []*tenpu.Hit
+	for i := range found {
+		hits = append(hits, &tenpu.Hit{Attachment: &found[i].Attachment, Score: found[i].Score})
+	}
+	r = tenpu.NewSearchResult(search, offset, hits)
+	return
+}
+
+// EnsureIndexes creates the indexes the lookups, QueryAttachments and
+// SearchAttachments use, it is meant to be called once at start up.
+func (s *Storage) EnsureIndexes() (err error) {
+	keys := [][]string{
+		{"ownerid", "uploadtime", "_id"},
+		{"ownerid", "filename", "_id"},
+		{"ownerid", "contentlength", "_id"},
+		{"groupid", "uploadtime", "_id"},
+		{"ownerid", "tags"},
+		{"uploadtime", "_id"},
+		{"sha256", "contentlength"},
+		{"blobid"},
+		{"revisions.blobid"},
+		{"deletedat"},
+	}
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		for _, key := range keys {
+			if err = c.EnsureIndex(mgo.Index{Key: key, Background: true}); err != nil {
+				return
+			}
+		}
+		// filenames are not in a language, so the words are not stemmed
+		err = c.EnsureIndex(mgo.Index{
+			Name:            "search",
+			Key:             []string{"$text:filename", "$text:tags", "$text:category", "$text:attrvalues", "$text:text"},
+			Background:      true,
+			DefaultLanguage: "none",
+			Weights: map[string]int{
+				"filename":   tenpu.FilenameWeight,
+				"tags":       tenpu.TagWeight,
+				"category":   tenpu.CategoryWeight,
+				"attrvalues": tenpu.AttrWeight,
+				"text":       tenpu.TextWeight,
+			},
+		})
+	})
+	return
+}
+
+// live narrows query to the attachments not in the trash.
+func live(query bson.M) bson.M {
+	query["deletedat"] = bson.M{"$in": []interface{}{nil, time.Time{}}}
+	return query
+}
+
+// one turns the not found error of Query.One into a nil result, a lookup
+// that finds nothing is not a failure.
+func one(r *tenpu.Attachment, err error) (*tenpu.Attachment, error) {
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
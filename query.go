@@ -0,0 +1,270 @@
+package tenpu
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sort is the order of the attachments a Query gives.
+type Sort string
+
+const (
+	// SortByTime orders by UploadTime, it is the default.
+	SortByTime Sort = "time"
+	// SortByName orders by Filename.
+	SortByName Sort = "name"
+	// SortBySize orders by ContentLength.
+	SortBySize Sort = "size"
+)
+
+// The page sizes of a Query.
+const (
+	DefaultQueryLimit = 50
+	MaxQueryLimit     = 1000
+)
+
+// Query selects a page of the attachments not in the trash. The zero value
+// of each filter matches every attachment.
+type Query struct {
+	// OwnerIds matches the attachments of any of the owners.
+	OwnerIds []string
+	GroupId  string
+	Category string
+	// ContentTypePrefix matches the content types starting with it, like
+	// "image/".
+	ContentTypePrefix string
+	// UploadedAfter and UploadedBefore bound UploadTime, the first one
+	// included.
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+	// MinSize and MaxSize bound ContentLength, both included. A MaxSize of
+	// zero is no bound.
+	MinSize int64
+	MaxSize int64
+	// Tags matches the attachments labelled with all of them.
+	Tags []string
+	// Attrs matches the attachments with each of the attributes set to the
+	// value given.
+	Attrs map[string]string
+
+	Sort       Sort
+	Descending bool
+	// Limit is the page size, DefaultQueryLimit when zero and at most
+	// MaxQueryLimit.
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first.
+	Cursor string
+}
+
+// Page is a page of the attachments of a Query.
+type Page struct {
+	Attachments []*Attachment
+	// NextCursor gives the next page as the Cursor of the same Query, it is
+	// empty on the last page.
+	NextCursor string
+}
+
+// Querier is implemented by MetaStorages that can page through attachments
+// by a Query, instead of loading all of them.
+type Querier interface {
+	QueryAttachments(q *Query) (page *Page, err error)
+}
+
+// Cursor is the position after the last attachment of a page. Pages are
+// keyed on the sort field and then the attachment id, so attachments added
+// or removed between pages do not shift the ones after the cursor.
+type Cursor struct {
+	Sort          Sort
+	Descending    bool
+	UploadTime    time.Time `json:",omitempty"`
+	Filename      string    `json:",omitempty"`
+	ContentLength int64     `json:",omitempty"`
+	Id            string
+}
+
+// ParseSort reads the Sort of s, "" being SortByTime.
+func ParseSort(s string) (r Sort, err error) {
+	switch r = Sort(s); r {
+	case "":
+		r = SortByTime
+	case SortByTime, SortByName, SortBySize:
+	default:
+		err = fmt.Errorf("%w: sort %q", ErrInvalid, s)
+	}
+	return
+}
+
+// Validate checks q and fills in its defaults.
+func (q *Query) Validate() (err error) {
+	if q.Sort, err = ParseSort(string(q.Sort)); err != nil {
+		return
+	}
+	if q.Limit < 0 {
+		err = fmt.Errorf("%w: limit %d", ErrInvalid, q.Limit)
+		return
+	}
+	if q.Limit == 0 {
+		q.Limit = DefaultQueryLimit
+	}
+	if q.Limit > MaxQueryLimit {
+		q.Limit = MaxQueryLimit
+	}
+	if err = ValidateAttrs(q.Attrs); err != nil {
+		return
+	}
+	if q.MinSize < 0 || q.MaxSize < 0 || (q.MaxSize > 0 && q.MaxSize < q.MinSize) {
+		err = fmt.Errorf("%w: size range %d to %d", ErrInvalid, q.MinSize, q.MaxSize)
+		return
+	}
+	return
+}
+
+// ParseCursor decodes the Cursor of q, nil for the first page. A cursor of
+// another sort or order is invalid.
+func (q *Query) ParseCursor() (c *Cursor, err error) {
+	if q.Cursor == "" {
+		return
+	}
+	b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err == nil {
+		c = &Cursor{}
+		err = json.Unmarshal(b, c)
+	}
+	if err != nil {
+		c = nil
+		err = fmt.Errorf("%w: cursor: %v", ErrInvalid, err)
+		return
+	}
+	if c.Sort != q.Sort || c.Descending != q.Descending || c.Id == "" {
+		c = nil
+		err = fmt.Errorf("%w: cursor is not of this sort", ErrInvalid)
+	}
+	return
+}
+
+// Match tells if att passes the filters of q. The MetaStorages that filter
+// in memory use it.
+func (q *Query) Match(att *Attachment) bool {
+	switch {
+	case att.Trashed():
+		return false
+	case len(q.OwnerIds) > 0 && !containsAny(att.OwnerId, q.OwnerIds):
+		return false
+	case q.GroupId != "" && !containsAny(att.GroupId, []string{q.GroupId}):
+		return false
+	case q.Category != "" && att.Category != q.Category:
+		return false
+	case !strings.HasPrefix(att.ContentType, q.ContentTypePrefix):
+		return false
+	case !q.UploadedAfter.IsZero() && att.UploadTime.Before(q.UploadedAfter):
+		return false
+	case !q.UploadedBefore.IsZero() && !att.UploadTime.Before(q.UploadedBefore):
+		return false
+	case att.ContentLength < q.MinSize:
+		return false
+	case q.MaxSize > 0 && att.ContentLength > q.MaxSize:
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !att.HasTag(tag) {
+			return false
+		}
+	}
+	for name, v := range q.Attrs {
+		if value, ok := att.Attrs[name]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Less tells if a comes before b in the order of q.
+func (q *Query) Less(a, b *Attachment) bool {
+	c := compare(q.Sort, cursorOf(q, a), cursorOf(q, b))
+	if q.Descending {
+		return c > 0
+	}
+	return c < 0
+}
+
+// After tells if att comes after the cursor c in the order of q.
+func (q *Query) After(c *Cursor, att *Attachment) bool {
+	if c == nil {
+		return true
+	}
+	r := compare(q.Sort, c, cursorOf(q, att))
+	if q.Descending {
+		return r > 0
+	}
+	return r < 0
+}
+
+// NewPage makes the page of q out of atts, which are in the order of q and
+// may hold one more attachment than the limit, to tell there is a next
+// page.
+func NewPage(q *Query, atts []*Attachment) (page *Page, err error) {
+	page = &Page{Attachments: atts}
+	if len(atts) <= q.Limit {
+		return
+	}
+	page.Attachments = atts[:q.Limit]
+
+	b, err := json.Marshal(cursorOf(q, page.Attachments[q.Limit-1]))
+	if err != nil {
+		return
+	}
+	page.NextCursor = base64.RawURLEncoding.EncodeToString(b)
+	return
+}
+
+func cursorOf(q *Query, att *Attachment) (c *Cursor) {
+	c = &Cursor{Sort: q.Sort, Descending: q.Descending, Id: att.Id}
+	switch q.Sort {
+	case SortByName:
+		c.Filename = att.Filename
+	case SortBySize:
+		c.ContentLength = att.ContentLength
+	default:
+		c.UploadTime = att.UploadTime
+	}
+	return
+}
+
+// compare orders a and b on the sort field and then the id.
+func compare(sort Sort, a, b *Cursor) int {
+	switch sort {
+	case SortByName:
+		if c := strings.Compare(a.Filename, b.Filename); c != 0 {
+			return c
+		}
+	case SortBySize:
+		if a.ContentLength != b.ContentLength {
+			if a.ContentLength < b.ContentLength {
+				return -1
+			}
+			return 1
+		}
+	default:
+		if !a.UploadTime.Equal(b.UploadTime) {
+			if a.UploadTime.Before(b.UploadTime) {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(a.Id, b.Id)
+}
+
+func containsAny(values []string, vs []string) bool {
+	for _, value := range values {
+		for _, v := range vs {
+			if value == v {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,482 @@
+package tenpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Revision is a prior body of an attachment.
+type Revision struct {
+	Number int
+	// BlobId is the id the body is stored under in BlobStorage, never empty.
+	BlobId        string
+	Filename      string
+	ContentType   string
+	MD5           string
+	SHA256        string
+	ContentLength int64
+	UploadTime    time.Time
+	UploadedBy    string
+	Width         int
+	Height        int
+}
+
+// RevisionInput is implemented by the Inputs and UploadInputs that can
+// address a revision of an attachment.
+type RevisionInput interface {
+	// GetRevision gives the attachment id and the revision number, zero
+	// for the current one.
+	GetRevision() (id string, revision int)
+}
+
+// RevisionSwapper is implemented by MetaStorages that can store att only
+// while the attachment they hold is still at Revision revision, in one
+// step. It keeps concurrent revisions of an attachment, even of different
+// processes, from overwriting each other.
+type RevisionSwapper interface {
+	SwapRevision(ctx context.Context, att *Attachment, revision int) (swapped bool, err error)
+}
+
+// InputRevision is the revision number input addresses, zero for the
+// current one or when it is not a RevisionInput.
+func InputRevision(input interface{}) (n int) {
+	if ri, ok := input.(RevisionInput); ok {
+		_, n = ri.GetRevision()
+	}
+	return
+}
+
+// CurrentRevision is the number of the current body of att.
+func (att *Attachment) CurrentRevision() int {
+	if att.Revision == 0 {
+		return 1
+	}
+	return att.Revision
+}
+
+// AtRevision gives att as it was at revision n, nil if there is no such
+// revision. The current revision gives att itself.
+func (att *Attachment) AtRevision(n int) (r *Attachment) {
+	if n == att.CurrentRevision() {
+		return att
+	}
+	for _, rev := range att.Revisions {
+		if rev.Number == n {
+			c := *att
+			c.Revisions = nil
+			c.setBody(rev)
+			return &c
+		}
+	}
+	return
+}
+
+// History gives att at each of its revisions, oldest first.
+func (att *Attachment) History() (r []*Attachment) {
+	for _, rev := range att.Revisions {
+		r = append(r, att.AtRevision(rev.Number))
+	}
+	r = append(r, att)
+	return
+}
+
+// BlobIds are the ids of the blobs of all revisions of att, each once.
+func (att *Attachment) BlobIds() (r []string) {
+	seen := map[string]bool{}
+	for _, id := range append([]string{att.BodyId()}, revisionBlobIds(att)...) {
+		if !seen[id] {
+			seen[id] = true
+			r = append(r, id)
+		}
+	}
+	return
+}
+
+func revisionBlobIds(att *Attachment) (r []string) {
+	for _, rev := range att.Revisions {
+		r = append(r, rev.BlobId)
+	}
+	return
+}
+
+// currentBody is the current body of att as a Revision.
+func (att *Attachment) currentBody() *Revision {
+	return &Revision{
+		Number:        att.CurrentRevision(),
+		BlobId:        att.BodyId(),
+		Filename:      att.Filename,
+		ContentType:   att.ContentType,
+		MD5:           att.MD5,
+		SHA256:        att.SHA256,
+		ContentLength: att.ContentLength,
+		UploadTime:    att.UploadTime,
+		UploadedBy:    att.UploadedBy,
+		Width:         att.Width,
+		Height:        att.Height,
+	}
+}
+
+func (att *Attachment) setBody(rev *Revision) {
+	att.Revision = rev.Number
+	att.BlobId = rev.BlobId
+	if att.BlobId == att.Id {
+		att.BlobId = ""
+	}
+	att.Filename = rev.Filename
+	att.ContentType = rev.ContentType
+	att.MD5 = rev.MD5
+	att.SHA256 = rev.SHA256
+	att.ContentLength = rev.ContentLength
+	att.UploadTime = rev.UploadTime
+	att.UploadedBy = rev.UploadedBy
+	att.Width = rev.Width
+	att.Height = rev.Height
+	// the text is of the prior body, a PostUploader sets it again
+	att.Text = ""
+}
+
+// pushRevision keeps the current body of att in its history and makes rev
+// the current one, as the next revision.
+func (att *Attachment) pushRevision(rev *Revision) {
+	att.Revisions = append(att.Revisions, att.currentBody())
+	rev.Number = att.CurrentRevision() + 1
+	att.setBody(rev)
+}
+
+func CreateRevision(input UploadInput, blob BlobStorage, meta MetaStorage, body io.Reader) (att *Attachment, err error) {
+	return CreateRevisionContext(context.Background(), input, blob, meta, body)
+}
+
+// CreateRevisionContext stores body as the new current revision of the
+// attachment addressed by input, which must be a RevisionInput. The Id of
+// the attachment stays the same, its prior body is kept in Revisions.
+// When another revision is stored while body is, this one fails with
+// ErrConflict and its blob is deleted, see updateAttachment.
+func CreateRevisionContext(ctx context.Context, input UploadInput, blob BlobStorage, meta MetaStorage, body io.Reader) (att *Attachment, err error) {
+	cblob, cmeta := BlobContext(blob), MetaContext(meta)
+
+	ri, ok := input.(RevisionInput)
+	if !ok {
+		err = fmt.Errorf("%w: input %T does not address revisions", ErrInvalid, input)
+		return
+	}
+	id, _ := ri.GetRevision()
+	if att, err = liveAttachment(ctx, cmeta, id); err != nil {
+		return
+	}
+
+	// the new body is stored like a new attachment, it gets its own blob
+	// id, and only its body fields are taken
+	upload := &Attachment{}
+	if err = input.SetAttrsForCreate(upload); err != nil {
+		return
+	}
+	filename, contentType, _ := input.GetFileMeta()
+	upload.UploadTime = time.Now()
+
+	defer func() {
+		if err != nil && upload.Id != "" {
+			rollbackBlob(context.WithoutCancel(ctx), cblob, upload)
+		}
+	}()
+
+	if err = putBody(ctx, cblob, filename, contentType, body, upload); err != nil {
+		return
+	}
+	var copyId string
+	if copyId, err = dedup(meta, upload); err != nil {
+		return
+	}
+
+	read := att.Revision
+	if att, err = updateAttachment(ctx, meta, id, func(att *Attachment) (err error) {
+		if err = revisionAt(att, read); err != nil {
+			return
+		}
+		att.pushRevision(upload.currentBody())
+		return
+	}); err != nil {
+		return
+	}
+	// the revision is stored, a cancel from here on does not undo it
+	if serr := settleDedup(ctx, cblob, cmeta, att, copyId); serr != nil {
+		log.Printf("tenpu: settle dedup of file id:%s revision:%d error: %v\n", att.Id, att.Revision, serr)
+	}
+	log.Printf("Upload file id:%s revision:%d, name:%s, size:%.2f M", att.Id, att.Revision, att.Filename, float32(att.ContentLength)/1024/1024)
+	return
+}
+
+func RevertAttachment(input Input, meta MetaStorage) (att *Attachment, err error) {
+	return RevertAttachmentContext(context.Background(), input, meta)
+}
+
+// RevertAttachmentContext makes a prior revision the current one again, as
+// a new revision on top of the history, which is kept whole.
+func RevertAttachmentContext(ctx context.Context, input Input, meta MetaStorage) (att *Attachment, err error) {
+	cmeta := MetaContext(meta)
+
+	ri, ok := input.(RevisionInput)
+	if !ok {
+		err = fmt.Errorf("%w: input %T does not address revisions", ErrInvalid, input)
+		return
+	}
+	id, n := ri.GetRevision()
+	if att, err = liveAttachment(ctx, cmeta, id); err != nil {
+		return
+	}
+
+	prior := att.AtRevision(n)
+	if prior == nil || prior == att {
+		err = fmt.Errorf("%w: revision %d of attachment id %s", ErrNotFound, n, id)
+		att = nil
+		return
+	}
+
+	rev := prior.currentBody()
+	rev.UploadTime = time.Now()
+	read := att.Revision
+	if att, err = updateAttachment(ctx, meta, id, func(att *Attachment) (err error) {
+		if err = revisionAt(att, read); err != nil {
+			return
+		}
+		att.pushRevision(rev)
+		return
+	}); err != nil {
+		return
+	}
+	log.Printf("Revert file id:%s to revision:%d as revision:%d", att.Id, n, att.Revision)
+	return
+}
+
+// updateTries is how many times updateAttachment reads and changes an
+// attachment that another process keeps storing revisions of.
+const updateTries = 3
+
+// updateAttachment reads the attachment of id, lets change edit it and
+// stores it, giving the stored one. While this process holds the lock of
+// the id, so its other updates of the attachment wait and read it after.
+// A RevisionSwapper stores it only if it is still at the revision read,
+// else it is read and changed again, so a revision stored by another
+// process is not overwritten. change sees the attachment even when it is
+// in the trash, and fails with an error to leave it as it is, or with
+// errUnchanged to leave it and give it with no error.
+func updateAttachment(ctx context.Context, meta MetaStorage, id string, change func(att *Attachment) error) (att *Attachment, err error) {
+	if id == "" {
+		err = fmt.Errorf("%w: attachment id required", ErrInvalid)
+		return
+	}
+	unlock := lockId(id)
+	defer unlock()
+
+	cmeta := MetaContext(meta)
+	sw, isSwapper := meta.(RevisionSwapper)
+	for try := 1; ; try++ {
+		if att, err = cmeta.AttachmentByIdContext(ctx, id); err != nil {
+			return
+		}
+		if att == nil {
+			err = fmt.Errorf("%w: attachment id %s", ErrNotFound, id)
+			return
+		}
+		read := att.Revision
+		if err = change(att); err == errUnchanged {
+			err = nil
+			return
+		}
+		if err != nil {
+			att = nil
+			return
+		}
+
+		if !isSwapper {
+			err = cmeta.PutContext(ctx, att)
+			return
+		}
+		var swapped bool
+		if swapped, err = sw.SwapRevision(ctx, att, read); err != nil || swapped {
+			return
+		}
+		if try == updateTries {
+			att = nil
+			err = fmt.Errorf("%w: attachment id %s keeps changing", ErrConflict, id)
+			return
+		}
+	}
+}
+
+// errUnchanged is given by the change of updateAttachment that has
+// nothing to store.
+var errUnchanged = errors.New("tenpu: unchanged")
+
+// revisionAt fails with ErrConflict when att is no longer at revision.
+func revisionAt(att *Attachment, revision int) (err error) {
+	if att.Trashed() {
+		err = fmt.Errorf("%w: attachment id %s", ErrNotFound, att.Id)
+		return
+	}
+	if att.Revision != revision {
+		err = fmt.Errorf("%w: attachment id %s is no longer at revision %d", ErrConflict, att.Id, revision)
+	}
+	return
+}
+
+// idLocks serialize updateAttachment per attachment id within the process.
+var idLocks = struct {
+	sync.Mutex
+	ids map[string]*idLock
+}{ids: map[string]*idLock{}}
+
+type idLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockId locks id in idLocks, until unlock is called.
+func lockId(id string) (unlock func()) {
+	idLocks.Lock()
+	l := idLocks.ids[id]
+	if l == nil {
+		l = &idLock{}
+		idLocks.ids[id] = l
+	}
+	l.users++
+	idLocks.Unlock()
+
+	l.Lock()
+	unlock = func() {
+		l.Unlock()
+		idLocks.Lock()
+		if l.users--; l.users == 0 {
+			delete(idLocks.ids, id)
+		}
+		idLocks.Unlock()
+	}
+	return
+}
+
+// liveAttachment loads the attachment of id, which must not be in the
+// trash.
+func liveAttachment(ctx context.Context, meta MetaStorageContext, id string) (att *Attachment, err error) {
+	if id == "" {
+		err = fmt.Errorf("%w: attachment id required", ErrInvalid)
+		return
+	}
+	att, err = meta.AttachmentByIdContext(ctx, id)
+	if err != nil {
+		return
+	}
+	if att == nil || att.Trashed() {
+		att = nil
+		err = fmt.Errorf("%w: attachment id %s", ErrNotFound, id)
+	}
+	return
+}
+
+// MakeRevisionUploader stores the first file of a multipart upload as the
+// new revision of the attachment the UploadInput addresses, see
+// RevisionInput.
+func MakeRevisionUploader(maker StorageMaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blob, meta, input, err := maker.MakeForUpload(r)
+		if err != nil {
+			writeError(w, err, nil)
+			return
+		}
+
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: %v", ErrInvalid, err), nil)
+			return
+		}
+
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			if !input.SetMultipart(part) {
+				continue
+			}
+
+			if ri, ok := input.(RevisionInput); ok {
+				id, _ := ri.GetRevision()
+				if err = authorizeId(maker, r, meta, id, ActionUpload); err != nil {
+					writeError(w, err, nil)
+					return
+				}
+			}
+
+			att, err := CreateRevisionContext(r.Context(), input, blob, meta, part)
+			if err != nil {
+				log.Printf("tenpu: upload revision name:%s error: %v\n", part.FileName(), err)
+				writeError(w, err, nil)
+				return
+			}
+			postUpload(maker, r, blob, meta, att)
+			writeJson(w, "", []*Attachment{att})
+			return
+		}
+
+		writeError(w, fmt.Errorf("%w: no attachments uploaded", ErrInvalid), nil)
+	}
+}
+
+// MakeRevisionLister lists the attachment of the Input id at each of its
+// revisions, oldest first.
+func MakeRevisionLister(maker StorageMaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, meta, input, err := maker.MakeForRead(r)
+		if err != nil {
+			writeError(w, err, nil)
+			return
+		}
+
+		id, _, _ := input.GetViewMeta()
+		att, err := liveAttachment(r.Context(), MetaContext(meta), id)
+		if err != nil {
+			writeError(w, err, nil)
+			return
+		}
+		if err = Authorize(maker, r, ActionRead, att); err != nil {
+			writeError(w, err, nil)
+			return
+		}
+
+		writeJson(w, "", att.History())
+	}
+}
+
+// MakeReverter reverts the attachment the Input addresses to one of its
+// revisions, see RevertAttachment.
+func MakeReverter(maker StorageMaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blob, meta, input, err := maker.MakeForRead(r)
+		if err != nil {
+			writeError(w, err, nil)
+			return
+		}
+
+		if ri, ok := input.(RevisionInput); ok {
+			id, _ := ri.GetRevision()
+			if err = authorizeId(maker, r, meta, id, ActionUpload); err != nil {
+				writeError(w, err, nil)
+				return
+			}
+		}
+
+		att, err := RevertAttachmentContext(r.Context(), input, meta)
+		if err != nil {
+			writeError(w, err, nil)
+			return
+		}
+		postUpload(maker, r, blob, meta, att)
+
+		writeJson(w, "", []*Attachment{att})
+	}
+}
@@ -0,0 +1,109 @@
+package s3blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/theplant/tenpu"
+)
+
+// objectReader reads an object with ranged GETs. Seeking only moves the
+// offset, the next Read starts a new request from there.
+type objectReader struct {
+	ctx     context.Context
+	storage *Storage
+	id      string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (s *Storage) Open(attachment *tenpu.Attachment) (r io.ReadSeekCloser, err error) {
+	return s.OpenContext(context.Background(), attachment)
+}
+
+// OpenContext opens the object of attachment, its reads stop with ctx.
+func (s *Storage) OpenContext(ctx context.Context, attachment *tenpu.Attachment) (r io.ReadSeekCloser, err error) {
+	res, err := s.do(ctx, "HEAD", attachment.BodyId(), nil, nil, nil)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = attachment.ContentLength
+		err = nil
+	}
+
+	r = &objectReader{ctx: ctx, storage: s, id: attachment.BodyId(), size: size}
+	return
+}
+
+func (r *objectReader) Read(p []byte) (n int, err error) {
+	if r.offset >= r.size {
+		err = io.EOF
+		return
+	}
+
+	if r.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+
+		var res *http.Response
+		res, err = r.storage.do(r.ctx, "GET", r.id, nil, header, nil)
+		if err != nil {
+			return
+		}
+		r.body = res.Body
+
+		// a server ignoring the range answers 200 with the whole object
+		if r.offset > 0 && res.StatusCode != http.StatusPartialContent {
+			if _, err = io.CopyN(ioutil.Discard, r.body, r.offset); err != nil {
+				r.Close()
+				return
+			}
+		}
+	}
+
+	n, err = r.body.Read(p)
+	r.offset += int64(n)
+	return
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (n int64, err error) {
+	switch whence {
+	case io.SeekStart:
+		n = offset
+	case io.SeekCurrent:
+		n = r.offset + offset
+	case io.SeekEnd:
+		n = r.size + offset
+	default:
+		err = errors.New("tenpu/s3blob: invalid whence")
+		return
+	}
+	if n < 0 {
+		err = errors.New("tenpu/s3blob: negative position")
+		return
+	}
+
+	if n != r.offset {
+		r.Close()
+		r.offset = n
+	}
+	return
+}
+
+func (r *objectReader) Close() (err error) {
+	if r.body != nil {
+		err = r.body.Close()
+		r.body = nil
+	}
+	return
+}
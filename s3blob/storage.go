@@ -0,0 +1,362 @@
+// Package s3blob stores attachment bodies as objects in an S3 compatible
+// service, like Amazon S3 or MinIO. Objects are addressed path style,
+// <Endpoint>/<Bucket>/<Prefix><attachment id>.
+package s3blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/theplant/tenpu"
+	_ "golang.org/x/image/bmp"
+)
+
+// DefaultPartSize is the multipart upload part size used when
+// Configuration.PartSize is not set.
+const DefaultPartSize = 8 << 20
+
+// MinPartSize is the smallest part S3 takes for all but the last part of a
+// multipart upload.
+const MinPartSize = 5 << 20
+
+type Configuration struct {
+	// Endpoint is the service base url, like "https://s3.amazonaws.com"
+	// or "http://localhost:9000".
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// PartSize is the size of each part for bodies that do not fit in one,
+	// they are sent with a multipart upload. It is raised to MinPartSize
+	// when set lower.
+	PartSize int
+	Client   *http.Client
+}
+
+type Storage struct {
+	config *Configuration
+}
+
+func NewStorage(config *Configuration) (s *Storage) {
+	c := *config
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.PartSize <= 0 {
+		c.PartSize = DefaultPartSize
+	}
+	if c.PartSize < MinPartSize {
+		c.PartSize = MinPartSize
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+
+	s = &Storage{config: &c}
+	return
+}
+
+func (s *Storage) Put(filename string, contentType string, body io.Reader, attachment *tenpu.Attachment) (err error) {
+	return s.PutContext(context.Background(), filename, contentType, body, attachment)
+}
+
+func (s *Storage) PutContext(ctx context.Context, filename string, contentType string, body io.Reader, attachment *tenpu.Attachment) (err error) {
+	id := attachment.BodyId()
+	if id == "" {
+		id, err = tenpu.NewId()
+		if err != nil {
+			return
+		}
+	}
+
+	// the buffer only grows as far as the body goes, so a small body stays
+	// small, and a large one reuses it for all its parts
+	hash := md5.New()
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, body, int64(s.config.PartSize))
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	// the image size is read before the parts take over the buffer
+	config, _, imageErr := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+
+	var size int64
+	if err == io.EOF {
+		err = s.putObject(ctx, id, contentType, buf.Bytes())
+		size = n
+		hash.Write(buf.Bytes())
+	} else {
+		size, err = s.putMultipart(ctx, id, contentType, &buf, body, hash)
+	}
+	if err != nil {
+		return
+	}
+
+	if attachment.Id == "" {
+		attachment.Id = id
+		attachment.ContentLength = size
+		attachment.ContentType = contentType
+		attachment.Filename = filename
+		attachment.MD5 = hex.EncodeToString(hash.Sum(nil))
+		if attachment.IsImage() && imageErr == nil {
+			attachment.Width = config.Width
+			attachment.Height = config.Height
+		}
+	}
+	return
+}
+
+func (s *Storage) CopyToStorage(attachment *tenpu.Attachment, toBlob tenpu.BlobStorage) (err error) {
+	return s.CopyToStorageContext(context.Background(), attachment, toBlob)
+}
+
+func (s *Storage) CopyToStorageContext(ctx context.Context, attachment *tenpu.Attachment, toBlob tenpu.BlobStorage) (err error) {
+	res, err := s.do(ctx, "GET", attachment.BodyId(), nil, nil, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	err = tenpu.BlobContext(toBlob).PutContext(ctx, attachment.Filename, attachment.ContentType, res.Body, attachment)
+	return
+}
+
+func (s *Storage) Copy(attachment *tenpu.Attachment, w io.Writer) (err error) {
+	return s.CopyContext(context.Background(), attachment, w)
+}
+
+func (s *Storage) CopyContext(ctx context.Context, attachment *tenpu.Attachment, w io.Writer) (err error) {
+	res, err := s.do(ctx, "GET", attachment.BodyId(), nil, nil, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(w, res.Body)
+	return
+}
+
+func (s *Storage) Zip(attachments []*tenpu.Attachment, w io.Writer) (err error) {
+	return tenpu.WriteZip(s, attachments, w)
+}
+
+func (s *Storage) ZipContext(ctx context.Context, attachments []*tenpu.Attachment, w io.Writer) (err error) {
+	return tenpu.DefaultZipBuilder.Write(ctx, s, attachments, w)
+}
+
+func (s *Storage) Delete(attachmentId string) (err error) {
+	return s.DeleteContext(context.Background(), attachmentId)
+}
+
+func (s *Storage) DeleteContext(ctx context.Context, attachmentId string) (err error) {
+	res, err := s.do(ctx, "DELETE", attachmentId, nil, nil, nil)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+	return
+}
+
+func (s *Storage) putObject(ctx context.Context, id string, contentType string, body []byte) (err error) {
+	sum := md5.Sum(body)
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	res, err := s.do(ctx, "PUT", id, nil, header, body)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+	return
+}
+
+type initiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// putMultipart sends buf, the first part, and then the rest of body in
+// PartSize parts read into buf, aborting the upload if anything goes wrong
+// on the way. The abort is sent even when ctx is what stopped the upload.
+func (s *Storage) putMultipart(ctx context.Context, id string, contentType string, buf *bytes.Buffer, body io.Reader, hash hash.Hash) (size int64, err error) {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+
+	var initiated initiateMultipartUploadResult
+	if err = s.doXML(ctx, "POST", id, url.Values{"uploads": {""}}, header, nil, &initiated); err != nil {
+		return
+	}
+	uploadId := url.Values{"uploadId": {initiated.UploadId}}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		if res, aerr := s.do(context.WithoutCancel(ctx), "DELETE", id, uploadId, nil, nil); aerr == nil {
+			res.Body.Close()
+		}
+	}()
+
+	var complete completeMultipartUpload
+	for number := 1; buf.Len() > 0; number++ {
+		part := buf.Bytes()
+		hash.Write(part)
+		size += int64(len(part))
+
+		query := url.Values{
+			"partNumber": {fmt.Sprintf("%d", number)},
+			"uploadId":   {initiated.UploadId},
+		}
+		var res *http.Response
+		res, err = s.do(ctx, "PUT", id, query, nil, part)
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{
+			PartNumber: number,
+			ETag:       res.Header.Get("ETag"),
+		})
+
+		buf.Reset()
+		if _, err = io.CopyN(buf, body, int64(s.config.PartSize)); err != nil && err != io.EOF {
+			return
+		}
+		err = nil
+	}
+
+	b, err := xml.Marshal(complete)
+	if err != nil {
+		return
+	}
+	err = s.doXML(ctx, "POST", id, uploadId, nil, b, nil)
+	return
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+	status  int
+}
+
+func (e *s3Error) Error() string {
+	return "tenpu/s3blob: " + e.Code + ": " + e.Message
+}
+
+// Is maps S3 failures to the tenpu errors.
+func (e *s3Error) Is(target error) bool {
+	switch target {
+	case tenpu.ErrForbidden:
+		return e.status == http.StatusForbidden || e.Code == "AccessDenied"
+	case tenpu.ErrTooLarge:
+		return e.Code == "EntityTooLarge"
+	case tenpu.ErrInvalid:
+		return e.status == http.StatusBadRequest && e.Code != "EntityTooLarge"
+	}
+	return false
+}
+
+// doXML is do for the calls answering with a xml document. S3 may answer
+// 200 with an <Error> document, that is turned into an error as well.
+func (s *Storage) doXML(ctx context.Context, method string, id string, query url.Values, header http.Header, body []byte, result interface{}) (err error) {
+	res, err := s.do(ctx, method, id, query, header, body)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+
+	if bytes.Contains(b, []byte("<Error>")) {
+		e := &s3Error{}
+		if xml.Unmarshal(b, e) == nil {
+			err = e
+			return
+		}
+	}
+
+	if result != nil {
+		err = xml.Unmarshal(b, result)
+	}
+	return
+}
+
+// do sends a signed request for the object of id. Any non 2xx answer is an
+// error, a missing object is tenpu.ErrNotFound.
+func (s *Storage) do(ctx context.Context, method string, id string, query url.Values, header http.Header, body []byte) (res *http.Response, err error) {
+	if id == "" {
+		err = fmt.Errorf("%w: tenpu/s3blob: attachment id required", tenpu.ErrInvalid)
+		return
+	}
+
+	u := s.config.Endpoint + "/" + uriEncode(s.config.Bucket, true) + "/" + uriEncode(s.config.Prefix+id, false)
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.ContentLength = int64(len(body))
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	s.sign(req, hashHex(body))
+
+	res, err = s.config.Client.Do(req)
+	if err != nil {
+		return
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		err = tenpu.ErrNotFound
+		return
+	}
+
+	e := &s3Error{status: res.StatusCode}
+	b, _ := ioutil.ReadAll(res.Body)
+	if xml.Unmarshal(b, e) != nil || e.Code == "" {
+		e.Code = res.Status
+	}
+	err = e
+	return
+}
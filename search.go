@@ -0,0 +1,230 @@
+package tenpu
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The weights of the fields of an attachment a search term is found in,
+// the score of a hit is their sum over the terms.
+const (
+	FilenameWeight = 10
+	TagWeight      = 5
+	CategoryWeight = 3
+	AttrWeight     = 1
+	TextWeight     = 1
+)
+
+// Search finds the attachments of some owners by the words of their
+// filename, tags, category, attribute values and Text.
+type Search struct {
+	// Text is the words searched for, an attachment matching any of them
+	// is a hit.
+	Text string
+	// OwnerIds scope the search, at least one is required.
+	OwnerIds []string
+	// Limit is the page size, as for Query.
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty for the first.
+	Cursor string
+}
+
+// Hit is an attachment found by a Search.
+type Hit struct {
+	*Attachment
+	Score float64
+}
+
+// SearchResult is a page of the hits of a Search, the best first.
+type SearchResult struct {
+	Hits []*Hit
+	// NextCursor gives the next page as the Cursor of the same Search, it
+	// is empty on the last page.
+	NextCursor string
+}
+
+// Searcher is implemented by MetaStorages that can search with an index.
+// SearchAttachments falls back to scoring every attachment of the owners
+// for the ones that do not.
+type Searcher interface {
+	SearchAttachments(s *Search) (r *SearchResult, err error)
+}
+
+// Validate checks s and fills in its defaults.
+func (s *Search) Validate() (err error) {
+	if len(SearchTerms(s.Text)) == 0 {
+		err = fmt.Errorf("%w: search text required", ErrInvalid)
+		return
+	}
+	if len(s.OwnerIds) == 0 {
+		err = fmt.Errorf("%w: search owner required", ErrInvalid)
+		return
+	}
+	q := &Query{Limit: s.Limit}
+	err = q.Validate()
+	s.Limit = q.Limit
+	return
+}
+
+// Offset is the number of hits before the page of the Cursor of s.
+func (s *Search) Offset() (offset int, err error) {
+	if s.Cursor == "" {
+		return
+	}
+	if offset, err = strconv.Atoi(s.Cursor); err != nil || offset < 0 {
+		offset = 0
+		err = fmt.Errorf("%w: cursor %q", ErrInvalid, s.Cursor)
+	}
+	return
+}
+
+// NewSearchResult makes the page of s at offset out of hits, which may hold
+// one more than the limit, to tell there is a next page.
+func NewSearchResult(s *Search, offset int, hits []*Hit) (r *SearchResult) {
+	r = &SearchResult{Hits: hits}
+	if len(hits) > s.Limit {
+		r.Hits = hits[:s.Limit]
+		r.NextCursor = strconv.Itoa(offset + s.Limit)
+	}
+	return
+}
+
+// SearchTerms splits text into the lower case words a search matches.
+func SearchTerms(text string) (r []string) {
+	return strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// SearchAttachments gives a page of the hits of s in meta, with the
+// Searcher of meta when it has one. Without it, the terms match anywhere
+// in a field, so fragments of words are found too, and the hits are
+// ranked by the weights of the fields, then the newest first.
+func SearchAttachments(meta MetaStorage, s *Search) (r *SearchResult, err error) {
+	if err = s.Validate(); err != nil {
+		return
+	}
+	if searcher, ok := meta.(Searcher); ok {
+		return searcher.SearchAttachments(s)
+	}
+
+	offset, err := s.Offset()
+	if err != nil {
+		return
+	}
+	atts, err := meta.AttachmentsByOwnerIds(s.OwnerIds)
+	if err != nil {
+		return
+	}
+
+	terms := SearchTerms(s.Text)
+	var hits []*Hit
+	for _, att := range atts {
+		if score := searchScore(att, terms); score > 0 {
+			hits = append(hits, &Hit{att, score})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if !a.UploadTime.Equal(b.UploadTime) {
+			return a.UploadTime.After(b.UploadTime)
+		}
+		return a.Id < b.Id
+	})
+
+	if offset > len(hits) {
+		offset = len(hits)
+	}
+	hits = hits[offset:]
+	if len(hits) > s.Limit+1 {
+		hits = hits[:s.Limit+1]
+	}
+	r = NewSearchResult(s, offset, hits)
+	return
+}
+
+func searchScore(att *Attachment, terms []string) (score float64) {
+	filename := strings.ToLower(att.Filename)
+	category := strings.ToLower(att.Category)
+	text := strings.ToLower(att.Text)
+	for _, term := range terms {
+		if strings.Contains(filename, term) {
+			score += FilenameWeight
+		}
+		for _, tag := range att.Tags {
+			if strings.Contains(strings.ToLower(tag), term) {
+				score += TagWeight
+				break
+			}
+		}
+		if strings.Contains(category, term) {
+			score += CategoryWeight
+		}
+		for _, v := range att.Attrs {
+			if strings.Contains(strings.ToLower(v), term) {
+				score += AttrWeight
+				break
+			}
+		}
+		if strings.Contains(text, term) {
+			score += TextWeight
+		}
+	}
+	return
+}
+
+// MakeSearchAPI serves SearchAttachments as JSON:
+//
+//	GET ?q=words&owner=a&owner=b&limit=n&cursor=c
+//
+// It gives a SearchResult, or an APIError with the status of StatusCode.
+// Every hit is checked with the Authorizer of maker, if it has one.
+func MakeSearchAPI(maker StorageMaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeAPIStatus(w, http.StatusMethodNotAllowed, &APIError{"method not allowed"})
+			return
+		}
+		_, meta, _, err := maker.MakeForRead(r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+
+		query := r.URL.Query()
+		s := &Search{
+			Text:     query.Get("q"),
+			OwnerIds: query["owner"],
+			Cursor:   query.Get("cursor"),
+		}
+		if v := query.Get("limit"); v != "" {
+			if s.Limit, err = strconv.Atoi(v); err != nil {
+				writeAPIError(w, fmt.Errorf("%w: limit: %v", ErrInvalid, err))
+				return
+			}
+		}
+
+		result, err := SearchAttachments(meta, s)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		for _, hit := range result.Hits {
+			if err = Authorize(maker, r, ActionRead, hit.Attachment); err != nil {
+				writeAPIError(w, err)
+				return
+			}
+		}
+		if result.Hits == nil {
+			result.Hits = []*Hit{}
+		}
+		writeAPIStatus(w, http.StatusOK, result)
+	}
+}
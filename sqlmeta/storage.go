@@ -0,0 +1,664 @@
+// Package sqlmeta stores attachment meta in a database/sql database.
+//
+// Attachments live in one table, the multi valued OwnerId, GroupId, Tags
+// and Attrs are kept in join tables next to it. Call Migrate once on start
+// up to create or upgrade the tables.
+package sqlmeta
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/theplant/tenpu"
+)
+
+// Dialect picks the bind variable style of the database driver.
+type Dialect int
+
+const (
+	// QuestionMark is for SQLite and MySQL style "?" placeholders.
+	QuestionMark Dialect = iota
+	// Dollar is for Postgres style "$1" placeholders.
+	Dollar
+)
+
+type Storage struct {
+	db        *sql.DB
+	tableName string
+	dialect   Dialect
+}
+
+func NewStorage(db *sql.DB, tableName string, dialect Dialect) (s *Storage) {
+	s = &Storage{}
+	if tableName == "" {
+		tableName = "attachments"
+	}
+
+	s.db = db
+	s.tableName = tableName
+	s.dialect = dialect
+	return
+}
+
+// migrations are applied in order, the index of each is its schema version.
+// Only ever append to it.
+var migrations = []string{
+	// error has no DEFAULT, MySQL has none for TEXT before 8.0.13, put
+	// always writes it
+	`CREATE TABLE {{table}} (
+		id VARCHAR(64) NOT NULL PRIMARY KEY,
+		category VARCHAR(255) NOT NULL DEFAULT '',
+		filename VARCHAR(1024) NOT NULL DEFAULT '',
+		content_type VARCHAR(255) NOT NULL DEFAULT '',
+		content_id VARCHAR(255) NOT NULL DEFAULT '',
+		md5 VARCHAR(64) NOT NULL DEFAULT '',
+		content_length BIGINT NOT NULL DEFAULT 0,
+		error TEXT NOT NULL,
+		upload_time TIMESTAMP NOT NULL,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE {{table}}_owners (
+		attachment_id VARCHAR(64) NOT NULL,
+		owner_id VARCHAR(255) NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (attachment_id, owner_id)
+	)`,
+	`CREATE INDEX {{table}}_owners_owner_id ON {{table}}_owners (owner_id)`,
+	`CREATE TABLE {{table}}_groups (
+		attachment_id VARCHAR(64) NOT NULL,
+		group_id VARCHAR(255) NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (attachment_id, group_id)
+	)`,
+	`CREATE INDEX {{table}}_groups_group_id ON {{table}}_groups (group_id)`,
+	`ALTER TABLE {{table}} ADD COLUMN blob_id VARCHAR(64) NOT NULL DEFAULT ''`,
+	`CREATE INDEX {{table}}_blob_id ON {{table}} (blob_id)`,
+	`CREATE INDEX {{table}}_md5 ON {{table}} (md5, content_length)`,
+	`ALTER TABLE {{table}} ADD COLUMN deleted_at TIMESTAMP NULL`,
+	`CREATE INDEX {{table}}_deleted_at ON {{table}} (deleted_at)`,
+	`ALTER TABLE {{table}} ADD COLUMN uploaded_by VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE {{table}} ADD COLUMN revision INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE {{table}}_revisions (
+		attachment_id VARCHAR(64) NOT NULL,
+		number INTEGER NOT NULL,
+		blob_id VARCHAR(64) NOT NULL,
+		filename VARCHAR(1024) NOT NULL DEFAULT '',
+		content_type VARCHAR(255) NOT NULL DEFAULT '',
+		md5 VARCHAR(64) NOT NULL DEFAULT '',
+		content_length BIGINT NOT NULL DEFAULT 0,
+		upload_time TIMESTAMP NOT NULL,
+		uploaded_by VARCHAR(255) NOT NULL DEFAULT '',
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (attachment_id, number)
+	)`,
+	`CREATE INDEX {{table}}_revisions_blob_id ON {{table}}_revisions (blob_id)`,
+	`CREATE TABLE {{table}}_tags (
+		attachment_id VARCHAR(64) NOT NULL,
+		tag VARCHAR(255) NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (attachment_id, tag)
+	)`,
+	`CREATE INDEX {{table}}_tags_tag ON {{table}}_tags (tag)`,
+	`CREATE TABLE {{table}}_attrs (
+		attachment_id VARCHAR(64) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (attachment_id, name)
+	)`,
+	// NULL as MySQL has no DEFAULT for TEXT before 8.0.13, it reads as
+	// empty
+	`ALTER TABLE {{table}} ADD COLUMN text TEXT NULL`,
+	`ALTER TABLE {{table}} ADD COLUMN sha256 VARCHAR(64) NOT NULL DEFAULT ''`,
+	`CREATE INDEX {{table}}_sha256 ON {{table}} (sha256, content_length)`,
+	`ALTER TABLE {{table}}_revisions ADD COLUMN sha256 VARCHAR(64) NOT NULL DEFAULT ''`,
+}
+
+// Migrate creates the tables, or brings them up to the latest schema. The
+// applied version is recorded in the <table>_schema_version table.
+func (s *Storage) Migrate() (err error) {
+	_, err = s.db.Exec(s.sql(`CREATE TABLE IF NOT EXISTS {{table}}_schema_version (version INTEGER NOT NULL)`))
+	if err != nil {
+		return
+	}
+
+	var version int
+	err = s.db.QueryRow(s.sql(`SELECT COALESCE(MAX(version), 0) FROM {{table}}_schema_version`)).Scan(&version)
+	if err != nil {
+		return
+	}
+
+	for ; version < len(migrations); version++ {
+		var tx *sql.Tx
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+
+		if _, err = tx.Exec(s.sql(migrations[version])); err != nil {
+			tx.Rollback()
+			return
+		}
+		if _, err = tx.Exec(s.sql(`INSERT INTO {{table}}_schema_version (version) VALUES (?)`), version+1); err != nil {
+			tx.Rollback()
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Storage) Put(att *tenpu.Attachment) (err error) {
+	return s.PutContext(context.Background(), att)
+}
+
+func (s *Storage) PutContext(ctx context.Context, att *tenpu.Attachment) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	if err = s.put(ctx, tx, att); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+func (s *Storage) SwapRevision(ctx context.Context, att *tenpu.Attachment, revision int) (swapped bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	// the update locks the row, so a concurrent swap waits for this one
+	// and then finds the revision moved
+	res, err := tx.ExecContext(ctx, s.sql(`UPDATE {{table}} SET revision = ? WHERE id = ? AND revision = ?`), att.Revision, att.Id, revision)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 && att.Revision == revision {
+		// MySQL counts the rows changed, not the ones matched, and an
+		// update that keeps the revision changes none
+		err = tx.QueryRowContext(ctx, s.sql(`SELECT COUNT(*) FROM {{table}} WHERE id = ? AND revision = ?`), att.Id, revision).Scan(&n)
+	}
+	if err != nil || n == 0 {
+		tx.Rollback()
+		return
+	}
+
+	if err = s.put(ctx, tx, att); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	swapped = true
+	return
+}
+
+// put replaces att and its join table rows in tx.
+func (s *Storage) put(ctx context.Context, tx *sql.Tx, att *tenpu.Attachment) (err error) {
+	if err = s.remove(ctx, tx, att.Id); err != nil {
+		return
+	}
+
+	// every column is written, error has no default to fall back to
+	_, err = tx.ExecContext(ctx, s.sql(`INSERT INTO {{table}} (`+columns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		att.Id, att.Category, att.Filename, att.ContentType, att.ContentId, att.MD5,
+		att.ContentLength, att.Error, att.UploadTime, att.Width, att.Height, att.BlobId,
+		sql.NullTime{Time: att.DeletedAt, Valid: att.Trashed()}, att.UploadedBy, att.Revision, att.Text, att.SHA256)
+	if err != nil {
+		return
+	}
+
+	for i, ownerId := range unique(att.OwnerId) {
+		_, err = tx.ExecContext(ctx, s.sql(`INSERT INTO {{table}}_owners (attachment_id, owner_id, position) VALUES (?, ?, ?)`), att.Id, ownerId, i)
+		if err != nil {
+			return
+		}
+	}
+
+	for i, groupId := range unique(att.GroupId) {
+		_, err = tx.ExecContext(ctx, s.sql(`INSERT INTO {{table}}_groups (attachment_id, group_id, position) VALUES (?, ?, ?)`), att.Id, groupId, i)
+		if err != nil {
+			return
+		}
+	}
+
+	for i, tag := range unique(att.Tags) {
+		_, err = tx.ExecContext(ctx, s.sql(`INSERT INTO {{table}}_tags (attachment_id, tag, position) VALUES (?, ?, ?)`), att.Id, tag, i)
+		if err != nil {
+			return
+		}
+	}
+
+	for name, value := range att.Attrs {
+		_, err = tx.ExecContext(ctx, s.sql(`INSERT INTO {{table}}_attrs (attachment_id, name, value) VALUES (?, ?, ?)`), att.Id, name, value)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, rev := range att.Revisions {
+		_, err = tx.ExecContext(ctx, s.sql(`INSERT INTO {{table}}_revisions (attachment_id, `+revisionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			att.Id, rev.Number, rev.BlobId, rev.Filename, rev.ContentType, rev.MD5,
+			rev.ContentLength, rev.UploadTime, rev.UploadedBy, rev.Width, rev.Height, rev.SHA256)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Storage) Remove(id string) (err error) {
+	return s.RemoveContext(context.Background(), id)
+}
+
+func (s *Storage) RemoveContext(ctx context.Context, id string) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	if err = s.remove(ctx, tx, id); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+func (s *Storage) Attachments(ownerid string) (r []*tenpu.Attachment, err error) {
+	return s.AttachmentsContext(context.Background(), ownerid)
+}
+
+func (s *Storage) AttachmentsContext(ctx context.Context, ownerid string) (r []*tenpu.Attachment, err error) {
+	r, err = s.AttachmentsByOwnerIdsContext(ctx, []string{ownerid})
+	return
+}
+
+func (s *Storage) AttachmentsByOwnerIds(ownerids []string) (r []*tenpu.Attachment, err error) {
+	return s.AttachmentsByOwnerIdsContext(context.Background(), ownerids)
+}
+
+func (s *Storage) AttachmentsByOwnerIdsContext(ctx context.Context, ownerids []string) (r []*tenpu.Attachment, err error) {
+	// an attachment with owners in two chunks is read by both, it is kept
+	// once
+	seen := make(map[string]bool)
+	err = chunked(ownerids, func(chunk []string) (err error) {
+		atts, err := s.query(ctx, `WHERE deleted_at IS NULL AND id IN (SELECT attachment_id FROM {{table}}_owners WHERE owner_id IN (`+placeholders(len(chunk))+`))`, strings2args(chunk)...)
+		for _, att := range atts {
+			if !seen[att.Id] {
+				seen[att.Id] = true
+				r = append(r, att)
+			}
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortAttachments(r)
+	return
+}
+
+func (s *Storage) AttachmentsCountByOwnerIds(ownerids []string) (r int, err error) {
+	return s.AttachmentsCountByOwnerIdsContext(context.Background(), ownerids)
+}
+
+func (s *Storage) AttachmentsCountByOwnerIdsContext(ctx context.Context, ownerids []string) (r int, err error) {
+	if len(ownerids) == 0 {
+		return
+	}
+	if len(ownerids) <= maxBindVars {
+		err = s.db.QueryRowContext(ctx, s.sql(`SELECT COUNT(*) FROM {{table}} WHERE deleted_at IS NULL AND id IN (SELECT attachment_id FROM {{table}}_owners WHERE owner_id IN (`+placeholders(len(ownerids))+`))`), strings2args(ownerids)...).Scan(&r)
+		return
+	}
+
+	// the counts of the chunks can not be added up, an attachment with
+	// owners in two would be counted twice
+	seen := make(map[string]bool)
+	err = chunked(ownerids, func(chunk []string) (err error) {
+		rows, err := s.db.QueryContext(ctx, s.sql(`SELECT id FROM {{table}} WHERE deleted_at IS NULL AND id IN (SELECT attachment_id FROM {{table}}_owners WHERE owner_id IN (`+placeholders(len(chunk))+`))`), strings2args(chunk)...)
+		if err != nil {
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				return
+			}
+			seen[id] = true
+		}
+		err = rows.Err()
+		return
+	})
+	r = len(seen)
+	return
+}
+
+func (s *Storage) AttachmentById(id string) (r *tenpu.Attachment, err error) {
+	return s.AttachmentByIdContext(context.Background(), id)
+}
+
+func (s *Storage) AttachmentByIdContext(ctx context.Context, id string) (r *tenpu.Attachment, err error) {
+	r, err = s.queryOne(ctx, `WHERE id = ?`, id)
+	return
+}
+
+func (s *Storage) AttachmentByIds(ids []string) (r []*tenpu.Attachment, err error) {
+	return s.AttachmentByIdsContext(context.Background(), ids)
+}
+
+func (s *Storage) AttachmentByIdsContext(ctx context.Context, ids []string) (r []*tenpu.Attachment, err error) {
+	err = chunked(ids, func(chunk []string) (err error) {
+		atts, err := s.query(ctx, `WHERE deleted_at IS NULL AND id IN (`+placeholders(len(chunk))+`)`, strings2args(chunk)...)
+		r = append(r, atts...)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortAttachments(r)
+	return
+}
+
+func (s *Storage) AttachmentsByGroupId(groupId string) (r []*tenpu.Attachment, err error) {
+	return s.AttachmentsByGroupIdContext(context.Background(), groupId)
+}
+
+func (s *Storage) AttachmentsByGroupIdContext(ctx context.Context, groupId string) (r []*tenpu.Attachment, err error) {
+	r, err = s.query(ctx, `WHERE deleted_at IS NULL AND id IN (SELECT attachment_id FROM {{table}}_groups WHERE group_id = ?)`, groupId)
+	return
+}
+
+func (s *Storage) GroupStats(groupIds []string) (r []*tenpu.GroupStats, err error) {
+	byId := map[string]*tenpu.GroupStats{}
+	for _, groupId := range groupIds {
+		stats := &tenpu.GroupStats{GroupId: groupId}
+		byId[groupId] = stats
+		r = append(r, stats)
+	}
+	if len(groupIds) == 0 {
+		return
+	}
+
+	rows, err := s.db.Query(s.sql(`SELECT g.group_id, COUNT(*), COALESCE(SUM(a.content_length), 0)
+		FROM {{table}}_groups g JOIN {{table}} a ON a.id = g.attachment_id
+		WHERE a.deleted_at IS NULL AND g.group_id IN (`+placeholders(len(groupIds))+`) GROUP BY g.group_id`), strings2args(groupIds)...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var groupId string
+		var count int
+		var size int64
+		if err = rows.Scan(&groupId, &count, &size); err != nil {
+			return
+		}
+		byId[groupId].Count, byId[groupId].Size = count, size
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *Storage) AttachmentByContent(sha256 string, contentLength int64) (r *tenpu.Attachment, err error) {
+	r, err = s.queryOne(context.Background(), `WHERE deleted_at IS NULL AND sha256 = ? AND content_length = ?`, sha256, contentLength)
+	return
+}
+
+func (s *Storage) AttachmentsCountByBlobId(blobId string) (r int, err error) {
+	err = s.db.QueryRow(s.sql(`SELECT COUNT(*) FROM {{table}} WHERE blob_id = ? OR (id = ? AND blob_id = '')
+		OR id IN (SELECT attachment_id FROM {{table}}_revisions WHERE blob_id = ?)`), blobId, blobId, blobId).Scan(&r)
+	return
+}
+
+func (s *Storage) TrashedAttachments(deletedBefore time.Time) (r []*tenpu.Attachment, err error) {
+	r, err = s.query(context.Background(), `WHERE deleted_at IS NOT NULL AND deleted_at < ?`, deletedBefore)
+	return
+}
+
+// maxBindVars is the most ids bound in one statement.
+const maxBindVars = 500
+
+// chunked calls f with ids in chunks of at most maxBindVars, so a long list
+// stays under the bind variable limit of the database, 999 on older SQLite.
+func chunked(ids []string, f func(chunk []string) error) (err error) {
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > maxBindVars {
+			chunk = chunk[:maxBindVars]
+		}
+		ids = ids[len(chunk):]
+
+		if err = f(chunk); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// sortAttachments puts atts read in chunks back in the order of query.
+func sortAttachments(atts []*tenpu.Attachment) {
+	sort.SliceStable(atts, func(i, j int) bool {
+		if !atts[i].UploadTime.Equal(atts[j].UploadTime) {
+			return atts[i].UploadTime.Before(atts[j].UploadTime)
+		}
+		return atts[i].Id < atts[j].Id
+	})
+}
+
+const columns = `id, category, filename, content_type, content_id, md5, content_length, error, upload_time, width, height, blob_id, deleted_at, uploaded_by, revision, text, sha256`
+
+const revisionColumns = `number, blob_id, filename, content_type, md5, content_length, upload_time, uploaded_by, width, height, sha256`
+
+func (s *Storage) remove(ctx context.Context, tx *sql.Tx, id string) (err error) {
+	for _, table := range []string{"{{table}}_owners", "{{table}}_groups", "{{table}}_revisions", "{{table}}_tags", "{{table}}_attrs"} {
+		if _, err = tx.ExecContext(ctx, s.sql(`DELETE FROM `+table+` WHERE attachment_id = ?`), id); err != nil {
+			return
+		}
+	}
+	_, err = tx.ExecContext(ctx, s.sql(`DELETE FROM {{table}} WHERE id = ?`), id)
+	return
+}
+
+// query loads the attachments matching where, together with their owner and
+// group ids. The join tables are read with where as a subquery, not with
+// the ids found, so any number of attachments can match.
+func (s *Storage) query(ctx context.Context, where string, args ...interface{}) (r []*tenpu.Attachment, err error) {
+	rows, err := s.db.QueryContext(ctx, s.sql(`SELECT `+columns+` FROM {{table}} `+where+` ORDER BY upload_time, id`), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	byId := make(map[string]*tenpu.Attachment)
+	for rows.Next() {
+		att := &tenpu.Attachment{}
+		var deletedAt sql.NullTime
+		var text sql.NullString
+		err = rows.Scan(&att.Id, &att.Category, &att.Filename, &att.ContentType, &att.ContentId, &att.MD5,
+			&att.ContentLength, &att.Error, &att.UploadTime, &att.Width, &att.Height, &att.BlobId, &deletedAt,
+			&att.UploadedBy, &att.Revision, &text, &att.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		att.DeletedAt = deletedAt.Time
+		att.Text = text.String
+		byId[att.Id] = att
+		r = append(r, att)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(r) == 0 {
+		return
+	}
+
+	sub := `SELECT id FROM {{table}} ` + where
+	err = s.loadIds(ctx, "{{table}}_owners", "owner_id", sub, args, byId, func(att *tenpu.Attachment, v string) {
+		att.OwnerId = append(att.OwnerId, v)
+	})
+	if err == nil {
+		err = s.loadIds(ctx, "{{table}}_groups", "group_id", sub, args, byId, func(att *tenpu.Attachment, v string) {
+			att.GroupId = append(att.GroupId, v)
+		})
+	}
+	if err == nil {
+		err = s.loadIds(ctx, "{{table}}_tags", "tag", sub, args, byId, func(att *tenpu.Attachment, v string) {
+			att.Tags = append(att.Tags, v)
+		})
+	}
+	if err == nil {
+		err = s.loadAttrs(ctx, sub, args, byId)
+	}
+	if err == nil {
+		err = s.loadRevisions(ctx, sub, args, byId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *Storage) loadRevisions(ctx context.Context, sub string, args []interface{}, byId map[string]*tenpu.Attachment) (err error) {
+	rows, err := s.db.QueryContext(ctx, s.sql(`SELECT attachment_id, `+revisionColumns+` FROM {{table}}_revisions WHERE attachment_id IN (`+sub+`) ORDER BY attachment_id, number`), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var att string
+		rev := &tenpu.Revision{}
+		err = rows.Scan(&att, &rev.Number, &rev.BlobId, &rev.Filename, &rev.ContentType, &rev.MD5,
+			&rev.ContentLength, &rev.UploadTime, &rev.UploadedBy, &rev.Width, &rev.Height, &rev.SHA256)
+		if err != nil {
+			return
+		}
+		if a := byId[att]; a != nil {
+			a.Revisions = append(a.Revisions, rev)
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *Storage) loadAttrs(ctx context.Context, sub string, args []interface{}, byId map[string]*tenpu.Attachment) (err error) {
+	rows, err := s.db.QueryContext(ctx, s.sql(`SELECT attachment_id, name, value FROM {{table}}_attrs WHERE attachment_id IN (`+sub+`)`), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var att, name, value string
+		if err = rows.Scan(&att, &name, &value); err != nil {
+			return
+		}
+		a := byId[att]
+		if a == nil {
+			continue
+		}
+		if a.Attrs == nil {
+			a.Attrs = map[string]string{}
+		}
+		a.Attrs[name] = value
+	}
+	err = rows.Err()
+	return
+}
+
+// queryOne is query for the first match only, nil when none.
+func (s *Storage) queryOne(ctx context.Context, where string, args ...interface{}) (r *tenpu.Attachment, err error) {
+	atts, err := s.query(ctx, where, args...)
+	if len(atts) > 0 {
+		r = atts[0]
+	}
+	return
+}
+
+// loadIds reads the values of column of the attachments in sub, the ones
+// put after the attachments were read are left out.
+func (s *Storage) loadIds(ctx context.Context, table string, column string, sub string, args []interface{}, byId map[string]*tenpu.Attachment, add func(att *tenpu.Attachment, v string)) (err error) {
+	rows, err := s.db.QueryContext(ctx, s.sql(`SELECT attachment_id, `+column+` FROM `+table+` WHERE attachment_id IN (`+sub+`) ORDER BY attachment_id, position`), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var att, v string
+		if err = rows.Scan(&att, &v); err != nil {
+			return
+		}
+		if a := byId[att]; a != nil {
+			add(a, v)
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// sql fills in the table name and rewrites "?" placeholders for the dialect.
+func (s *Storage) sql(query string) string {
+	query = strings.Replace(query, "{{table}}", s.tableName, -1)
+	if s.dialect != Dollar {
+		return query
+	}
+
+	var buf strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&buf, "$%d", n)
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// unique drops the repeats of values, the join tables hold each once.
+func unique(values []string) (r []string) {
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			r = append(r, v)
+		}
+	}
+	return
+}
+
+func strings2args(values []string) (r []interface{}) {
+	for _, v := range values {
+		r = append(r, v)
+	}
+	return
+}
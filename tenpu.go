@@ -1,36 +1,58 @@
 package tenpu
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"path"
 	"time"
-
-	mgo "gopkg.in/mgo.v2"
 )
 
 type BlobStorage interface {
-	// Get(attachment *Attachment) (r io.Reader, err error)
+	// Open gives a seekable reader on the body of attachment, the caller must
+	// Close it.
+	Open(attachment *Attachment) (r io.ReadSeekCloser, err error)
 	Put(filename string, contentType string, body io.Reader, attachment *Attachment) (err error)
-	Delete(attachmentId string) (err error)
+	// Delete removes the body stored under blobId, see Attachment.BodyId.
+	Delete(blobId string) (err error)
 	Copy(attachment *Attachment, w io.Writer) (err error)
 	CopyToStorage(attachment *Attachment, toBlob BlobStorage) (err error)
 	// Find(collectionName string, query interface{}, result interface{}) (err error)
 	Zip(attachments []*Attachment, w io.Writer) (err error)
 }
 
+// MetaStorage keeps the attachments. A lookup that finds nothing gives a
+// nil or empty result with a nil error, the error is only for failures of
+// the storage itself. Attachments in the trash are left out of all lookups
+// but AttachmentById and the BlobCounter ones.
 type MetaStorage interface {
 	Put(att *Attachment) (err error)
 	Remove(id string) (err error)
-	Attachments(ownerid string) (r []*Attachment)
-	AttachmentsByOwnerIds(ownerids []string) (r []*Attachment)
-	AttachmentsCountByOwnerIds(ownerids []string) (r int)
-	AttachmentById(id string) (r *Attachment)
-	AttachmentByIds(ids []string) (r []*Attachment)
-	AttachmentsByGroupId(groupId string) (r *Attachment)
+	Attachments(ownerid string) (r []*Attachment, err error)
+	AttachmentsByOwnerIds(ownerids []string) (r []*Attachment, err error)
+	AttachmentsCountByOwnerIds(ownerids []string) (r int, err error)
+	AttachmentById(id string) (r *Attachment, err error)
+	AttachmentByIds(ids []string) (r []*Attachment, err error)
+	AttachmentsByGroupId(groupId string) (r []*Attachment, err error)
+}
+
+// BlobCounter is implemented by MetaStorages that can find attachments by
+// content. With it CreateAttachment makes identical uploads share one blob,
+// and PurgeAttachment only removes a blob with its last attachment.
+// AttachmentByContent finds an attachment by its SHA256, rather than the MD5
+// two different bodies can be crafted to share, and only the ones not in
+// the trash, their blob is about to go. AttachmentsCountByBlobId counts the
+// attachments using the blob in any of their revisions, trashed or not.
+type BlobCounter interface {
+	AttachmentByContent(sha256 string, contentLength int64) (r *Attachment, err error)
+	AttachmentsCountByBlobId(blobId string) (r int, err error)
 }
 
 type Input interface {
@@ -51,26 +73,93 @@ type StorageMaker interface {
 	MakeForUpload(r *http.Request) (blob BlobStorage, meta MetaStorage, input UploadInput, err error)
 }
 
+// PostUploader is implemented by StorageMakers that work on each body the
+// handlers store, once it is stored: a new attachment, a new revision or a
+// revert. An error is logged, the upload has succeeded by then.
+type PostUploader interface {
+	PostUpload(r *http.Request, blob BlobStorage, meta MetaStorage, att *Attachment) (err error)
+}
+
+// postUpload runs the PostUploader of maker, when it has one, on att.
+func postUpload(maker StorageMaker, r *http.Request, blob BlobStorage, meta MetaStorage, att *Attachment) {
+	pu, ok := maker.(PostUploader)
+	if !ok {
+		return
+	}
+	if err := pu.PostUpload(r, blob, meta, att); err != nil {
+		log.Printf("tenpu: post upload of file id:%s error: %v\n", att.Id, err)
+	}
+}
+
 type Attachment struct {
-	Id            string `bson:"_id"`
-	OwnerId       []string
-	Category      string
-	Filename      string
-	ContentType   string
-	ContentId     string
-	MD5           string
+	Id          string `bson:"_id"`
+	OwnerId     []string
+	Category    string
+	Filename    string
+	ContentType string
+	ContentId   string
+	MD5         string
+	// SHA256 is the hex SHA-256 of the body, taken as it is stored. Identical
+	// uploads are found by it, see BlobCounter.
+	SHA256 string
+	// BlobId is the id of the blob holding the body, when it is shared with
+	// another attachment of the same content. Empty means Id.
+	BlobId        string
 	ContentLength int64
 	Error         string
 	GroupId       []string
 	UploadTime    time.Time
 	Width         int
 	Height        int
+	// DeletedAt is when the attachment was moved to the trash, zero while
+	// it is not.
+	DeletedAt time.Time
+	// UploadedBy is who uploaded the current body, set by the UploadInput.
+	UploadedBy string
+	// Revision is the number of the current body, counting from 1. Zero is
+	// for attachments stored before revisions, and means 1.
+	Revision int
+	// Revisions are the prior bodies, oldest first.
+	Revisions []*Revision
+	// Attrs are free form fields, like alt text or a caption, see
+	// ValidateAttrs for the names allowed.
+	Attrs map[string]string
+	// Tags label the attachment, see CleanTags.
+	Tags []string
+	// Text is the plain text of the current body, for search. It is set
+	// after the upload, by a PostUploader, and left out of the JSON.
+	Text string `json:"-"`
 }
 
 func (att *Attachment) MakeId() interface{} {
 	return att.Id
 }
 
+// NewId makes a random 24 character hex id, the same shape as the bson ids
+// gridfs.Storage hands out, so ids stay interchangeable between backends.
+// The BlobStorages and UploadStores without ids of their own use it.
+func NewId() (id string, err error) {
+	b := make([]byte, 12)
+	if _, err = io.ReadFull(rand.Reader, b); err != nil {
+		return
+	}
+	id = hex.EncodeToString(b)
+	return
+}
+
+// Trashed tells if att is in the trash.
+func (att *Attachment) Trashed() bool {
+	return !att.DeletedAt.IsZero()
+}
+
+// BodyId is the id the body of att is stored under in BlobStorage.
+func (att *Attachment) BodyId() string {
+	if att.BlobId != "" {
+		return att.BlobId
+	}
+	return att.Id
+}
+
 func (att *Attachment) IsImage() (r bool) {
 	switch att.ContentType {
 	default:
@@ -91,81 +180,263 @@ func (att *Attachment) Extname() (r string) {
 }
 
 func DeleteAttachment(input Input, blob BlobStorage, meta MetaStorage) (att *Attachment, deleted bool, err error) {
+	return DeleteAttachmentContext(context.Background(), input, blob, meta)
+}
 
+// DeleteAttachmentContext moves the attachment of the input to the trash by
+// setting its DeletedAt. The blob is kept until a Purger removes it, so
+// RestoreAttachment can bring it back.
+func DeleteAttachmentContext(ctx context.Context, input Input, blob BlobStorage, meta MetaStorage) (att *Attachment, deleted bool, err error) {
 	id, _, _ := input.GetViewMeta()
 
-	if id == "" {
-		err = errors.New("id required.")
-		return
-	}
-
-	att = meta.AttachmentById(id)
-	if att == nil {
-		err = errors.New("Attachment not found ,id: " + id)
+	// the attachment is changed as it is stored, see updateAttachment
+	att, err = updateAttachment(ctx, meta, id, func(att *Attachment) (err error) {
+		if att.Trashed() {
+			err = fmt.Errorf("%w: attachment id %s", ErrNotFound, id)
+			return
+		}
+
+		shouldUpdate, _, err := input.SetAttrsForDelete(att)
+		if err != nil || shouldUpdate {
+			deleted = false
+			return
+		}
+
+		att.DeletedAt = time.Now()
+		deleted = true
 		return
-	}
-
-	shouldUpdate, _, err := input.SetAttrsForDelete(att)
-
+	})
 	if err != nil {
+		deleted = false
 		return
 	}
-
-	if shouldUpdate {
-		err = meta.Put(att)
-		return
+	if deleted {
+		log.Printf("Trash file id:%s, name:%s, size:%.2f M", att.Id, att.Filename, float32(att.ContentLength)/1024/1024)
 	}
+	return
+}
 
-	err = blob.Delete(id)
-	if err != nil && err != mgo.ErrNotFound {
-		return
+// PurgeAttachmentContext removes att for good, the blobs of all its
+// revisions unless another attachment shares them, and its meta.
+func PurgeAttachmentContext(ctx context.Context, blob BlobStorage, meta MetaStorage, att *Attachment) (err error) {
+	cblob, cmeta := BlobContext(blob), MetaContext(meta)
+
+	for _, blobId := range att.BlobIds() {
+		if err = purgeBlob(ctx, cblob, meta, att, blobId); err != nil {
+			return
+		}
 	}
 
-	err = meta.Remove(id)
+	err = cmeta.RemoveContext(ctx, att.Id)
 	if err != nil {
 		return
 	}
 	log.Printf("Delete file id:%s, name:%s, size:%.2f M", att.Id, att.Filename, float32(att.ContentLength)/1024/1024)
+	return
+}
 
-	deleted = true
+// purgeBlob deletes blobId of att unless another attachment shares it. It
+// holds the lock of the blob, so settleDedup in this process either sees
+// it gone or is counted.
+func purgeBlob(ctx context.Context, blob BlobStorageContext, meta MetaStorage, att *Attachment, blobId string) (err error) {
+	unlock := lockId(blobLockId(blobId))
+	defer unlock()
 
+	shared, err := SharedBlob(meta, blobId)
+	if err != nil {
+		return
+	}
+	if shared {
+		log.Printf("Keep shared blob id:%s of file id:%s", blobId, att.Id)
+		return
+	}
+	err = blob.DeleteContext(ctx, blobId)
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
 	return
+}
 
+// blobLockId is the id blobId is locked under with lockId, apart from the
+// attachment of the same id.
+func blobLockId(blobId string) string {
+	return "blob:" + blobId
 }
 
 func CreateAttachment(input UploadInput, blob BlobStorage, meta MetaStorage, body io.Reader) (att *Attachment, err error) {
+	return CreateAttachmentContext(context.Background(), input, blob, meta, body)
+}
+
+func CreateAttachmentContext(ctx context.Context, input UploadInput, blob BlobStorage, meta MetaStorage, body io.Reader) (att *Attachment, err error) {
+	cblob, cmeta := BlobContext(blob), MetaContext(meta)
+
 	att = &Attachment{}
 	err = input.SetAttrsForCreate(att)
 
 	if err != nil {
 		return
 	}
+	if err = ValidateAttrs(att.Attrs); err != nil {
+		return
+	}
+	att.Tags = CleanTags(att.Tags)
 
 	filename, contentType, contentId := input.GetFileMeta()
 
 	att.UploadTime = time.Now()
 	att.ContentId = contentId
-
-	err = blob.Put(filename, contentType, body, att)
+	att.Revision = 1
+
+	// from here on a failure, or ctx being cancelled, must not leave the
+	// blob without its attachment, or the attachment without its blob
+	var copyId string
+	defer func() {
+		if err != nil {
+			rollback(ctx, cblob, cmeta, att)
+		}
+	}()
+
+	err = putBody(ctx, cblob, filename, contentType, body, att)
 	if err != nil {
 		return
 	}
 
-	err = meta.Put(att)
+	if copyId, err = dedup(meta, att); err != nil {
+		return
+	}
+
+	err = cmeta.PutContext(ctx, att)
 	if err != nil {
 		return
 	}
+	if err = settleDedup(ctx, cblob, cmeta, att, copyId); err != nil {
+		return
+	}
+
+	// a cancel that came while the meta was written still loses the
+	// request, so the upload is undone rather than reported as failed but
+	// kept
+	err = ctx.Err()
+	return
+}
+
+// putBody stores body for att, and sets its SHA256 on the way as the
+// BlobStorages only know of MD5.
+func putBody(ctx context.Context, blob BlobStorageContext, filename string, contentType string, body io.Reader, att *Attachment) (err error) {
+	h := sha256.New()
+	if err = blob.PutContext(ctx, filename, contentType, io.TeeReader(body, h), att); err != nil {
+		return
+	}
+	att.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// rollback removes what CreateAttachment stored for att before it failed.
+// It runs with ctx's values but without its cancel, as it is often the
+// cancel that made the upload fail. A blob shared with an existing
+// attachment is left alone.
+func rollback(ctx context.Context, blob BlobStorageContext, meta MetaStorageContext, att *Attachment) {
+	if att.Id == "" {
+		// the blob storage failed before storing anything
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	if err := meta.RemoveContext(ctx, att.Id); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("tenpu: rollback meta of file id:%s error: %v\n", att.Id, err)
+	}
+	rollbackBlob(ctx, blob, att)
+}
+
+// rollbackBlob deletes the blob just stored for att, under its Id. The blob
+// att was deduplicated into, if any, is left alone.
+func rollbackBlob(ctx context.Context, blob BlobStorageContext, att *Attachment) {
+	if err := blob.DeleteContext(ctx, att.Id); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("tenpu: rollback blob of file id:%s error: %v\n", att.Id, err)
+		return
+	}
+	log.Printf("Rollback file id:%s, name:%s", att.Id, att.Filename)
+}
+
+// dedup points att to the blob of an existing attachment with the same
+// content. The body has to be stored first to know its SHA256, so
+// identical uploads still write once. The copy just stored, copyId, is only deleted
+// by settleDedup once att is stored in meta.
+func dedup(meta MetaStorage, att *Attachment) (copyId string, err error) {
+	counter, ok := meta.(BlobCounter)
+	if !ok || att.SHA256 == "" {
+		return
+	}
+
+	existing, err := counter.AttachmentByContent(att.SHA256, att.ContentLength)
+	if err != nil || existing == nil || existing.Trashed() || existing.BodyId() == att.BodyId() {
+		return
+	}
+
+	copyId = att.BodyId()
+	att.BlobId = existing.BodyId()
+	return
+}
+
+// settleDedup deletes copyId, the blob att was stored in before dedup, now
+// that att in meta keeps the blob it shares from being purged. The blob
+// may have been purged before that though, then att gets its copy back.
+// It holds the lock of the shared blob, so a purge of it in this process
+// either went before and deleted it, or comes after and counts att, see
+// purgeBlob.
+func settleDedup(ctx context.Context, blob BlobStorageContext, meta MetaStorageContext, att *Attachment, copyId string) (err error) {
+	if copyId == "" {
+		return
+	}
+	unlock := lockId(blobLockId(att.BlobId))
+	defer unlock()
+
+	r, err := blob.OpenContext(ctx, att)
+	if err == nil {
+		r.Close()
+		if err = blob.DeleteContext(ctx, copyId); err != nil && !errors.Is(err, ErrNotFound) {
+			// only a leftover copy, att is fine
+			log.Printf("tenpu: delete duplicate blob id:%s of file id:%s error: %v\n", copyId, att.Id, err)
+		}
+		err = nil
+		return
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return
+	}
+
+	log.Printf("tenpu: shared blob id:%s of file id:%s was purged, keep its own", att.BlobId, att.Id)
+	att.BlobId = copyId
+	if copyId == att.Id {
+		att.BlobId = ""
+	}
+	err = meta.PutContext(ctx, att)
+	return
+}
 
+// SharedBlob tells if more than one attachment in meta uses the blob, in
+// which case it must not be deleted with one of them.
+func SharedBlob(meta MetaStorage, blobId string) (r bool, err error) {
+	counter, ok := meta.(BlobCounter)
+	if !ok {
+		return
+	}
+	count, err := counter.AttachmentsCountByBlobId(blobId)
+	r = count > 1
 	return
 }
 
 func CopyAttachment(fromBlob BlobStorage, toBlob BlobStorage, toMeta MetaStorage, att *Attachment) (err error) {
+	return CopyAttachmentContext(context.Background(), fromBlob, toBlob, toMeta, att)
+}
+
+func CopyAttachmentContext(ctx context.Context, fromBlob BlobStorage, toBlob BlobStorage, toMeta MetaStorage, att *Attachment) (err error) {
 
-	if err = fromBlob.CopyToStorage(att, toBlob); err != nil && err != mgo.ErrNotFound {
+	if err = BlobContext(fromBlob).CopyToStorageContext(ctx, att, toBlob); err != nil && !errors.Is(err, ErrNotFound) {
 		return
 	}
 
-	if err = toMeta.Put(att); err != nil {
+	if err = MetaContext(toMeta).PutContext(ctx, att); err != nil {
 		return
 	}
 	return
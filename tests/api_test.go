@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/memstore"
+)
+
+func TestMemstoreAPI(t *testing.T) {
+	m := newMemMaker()
+
+	ts := httptest.NewServer(tenpu.MakeAPI(m, "/api/attachments"))
+	defer ts.Close()
+
+	do := func(method string, path string, body string) (status int, b string) {
+		req, _ := http.NewRequest(method, ts.URL+"/api/attachments"+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		bs, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if ct := res.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("%s %s: %s", method, path, ct)
+		}
+		return res.StatusCode, string(bs)
+	}
+
+	var atts []*tenpu.Attachment
+	for _, owner := range []string{"o1", "o1", "o2"} {
+		att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "a.txt", ContentType: "text/plain", OwnerId: owner}, m.blob, m.meta, strings.NewReader("content of "+owner))
+		if err != nil {
+			t.Fatal(err)
+		}
+		atts = append(atts, att)
+	}
+
+	cases := []struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		contains string
+	}{
+		{"GET", "/" + atts[0].Id, "", http.StatusOK, `"Id":"` + atts[0].Id + `"`},
+		{"GET", "/nope", "", http.StatusNotFound, `"Error"`},
+		{"GET", "?id=" + atts[0].Id + "&id=" + atts[2].Id, "", http.StatusOK, atts[2].Id},
+		{"GET", "?owner=o1", "", http.StatusOK, `"Count":2`},
+		{"GET", "?group=none", "", http.StatusOK, `{"Attachments":[]}`},
+		{"GET", "", "", http.StatusBadRequest, `"Error"`},
+		{"POST", "", "", http.StatusMethodNotAllowed, `"Error"`},
+		{"PATCH", "/" + atts[0].Id, `{"Filename":"report, final.txt","GroupId":["g1"]}`, http.StatusOK, `"Filename":"report, final.txt"`},
+		{"GET", "?group=g1", "", http.StatusOK, atts[0].Id},
+		{"PATCH", "/" + atts[0].Id, `{"OwnerId":["o3"]}`, http.StatusBadRequest, `"Error"`},
+		{"PATCH", "/" + atts[0].Id, `{"Filename":""}`, http.StatusBadRequest, `"Error"`},
+		{"DELETE", "/" + atts[1].Id, "", http.StatusOK, atts[1].Id},
+		{"GET", "/" + atts[1].Id, "", http.StatusNotFound, `"Error"`},
+		{"GET", "?owner=o1", "", http.StatusOK, `"Count":1`},
+	}
+	for i, c := range cases {
+		status, body := do(c.method, c.path, c.body)
+		if status != c.status || !strings.Contains(body, c.contains) {
+			t.Errorf("%d: %s %s: %+v %s", i, c.method, c.path, status, body)
+		}
+	}
+}
+
+// raceMeta runs race, once, right after the at-th attachment is read, like
+// another process storing it while this one changes it.
+type raceMeta struct {
+	*memstore.MetaStorage
+	reads int
+	at    int
+	race  func()
+}
+
+func (m *raceMeta) AttachmentById(id string) (r *tenpu.Attachment, err error) {
+	r, err = m.MetaStorage.AttachmentById(id)
+	if m.reads++; m.reads == m.at && m.race != nil {
+		m.race()
+	}
+	return
+}
+
+func TestMemstoreAPIPatchRevision(t *testing.T) {
+	// the PATCH reads the attachment to authorize it and again to change
+	// it, a revision is stored after either read
+	for _, at := range []int{1, 2} {
+		m := newMemMaker()
+		att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "v1.txt", ContentType: "text/plain", OwnerId: "o1"}, m.blob, m.meta, strings.NewReader("first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		race := &raceMeta{MetaStorage: m.meta, at: at, race: func() {
+			stored, _ := m.meta.AttachmentById(att.Id)
+			stored.Revisions = []*tenpu.Revision{{Number: 1, BlobId: stored.Id, Filename: stored.Filename}}
+			stored.Revision, stored.BlobId, stored.Filename = 2, "otherblob", "v2.txt"
+			m.meta.Put(stored)
+		}}
+		m.readMeta = func(r *http.Request) (meta tenpu.MetaStorage, err error) {
+			meta = race
+			return
+		}
+
+		ts := httptest.NewServer(tenpu.MakeAPI(m, "/api/attachments"))
+		req, _ := http.NewRequest("PATCH", ts.URL+"/api/attachments/"+att.Id, strings.NewReader(`{"Category":"reports"}`))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ts.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%d: %+v %s", at, res.Status, b)
+		}
+
+		stored, _ := m.meta.AttachmentById(att.Id)
+		if stored.Category != "reports" || stored.Revision != 2 || stored.BlobId != "otherblob" || len(stored.Revisions) != 1 {
+			t.Errorf("%d: %+v", at, stored)
+		}
+	}
+}
+
+func TestMemstoreAPIAuthorizedList(t *testing.T) {
+	m := newMemMaker()
+	var ids []string
+	for _, owner := range []string{"o1", "o2", "o1"} {
+		att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "a.txt", ContentType: "text/plain", OwnerId: owner}, m.blob, m.meta, strings.NewReader("content of "+owner))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, att.Id)
+	}
+
+	ts := httptest.NewServer(tenpu.MakeAPI(&authorizer{m, ownerOnly}, "/api/attachments"))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		user   string
+		status int
+		ids    []string
+	}{
+		{"o1", http.StatusOK, []string{ids[0], ids[2]}},
+		{"o3", http.StatusOK, nil},
+		{"outage", http.StatusInternalServerError, nil},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/attachments?id="+strings.Join(ids, "&id="), nil)
+		req.Header.Set("X-User", c.user)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		var list tenpu.APIList
+		json.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+
+		var got []string
+		for _, att := range list.Attachments {
+			got = append(got, att.Id)
+		}
+		if res.StatusCode != c.status || strings.Join(got, ",") != strings.Join(c.ids, ",") {
+			t.Errorf("%s: %+v %+v", c.user, res.Status, got)
+		}
+	}
+}
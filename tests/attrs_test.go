@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theplant/tenpu"
+)
+
+type attrsInput struct {
+	tenpuInput
+	attrs map[string]string
+	tags  []string
+}
+
+func (d *attrsInput) SetAttrsForCreate(att *tenpu.Attachment) (err error) {
+	if err = d.tenpuInput.SetAttrsForCreate(att); err != nil {
+		return
+	}
+	att.Attrs, att.Tags = d.attrs, d.tags
+	return
+}
+
+func TestMemstoreAttrs(t *testing.T) {
+	m := newMemMaker()
+
+	input := &attrsInput{
+		tenpuInput: tenpuInput{FileName: "cat.png", ContentType: "image/png", OwnerId: "o1"},
+		attrs:      map[string]string{"alt": "a cat", "caption": "Tom"},
+		tags:       []string{" pets", "cats", "pets", ""},
+	}
+	att, err := tenpu.CreateAttachment(input, m.blob, m.meta, strings.NewReader("meow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(att.Tags, ",") != "pets,cats" {
+		t.Errorf("%+v", att.Tags)
+	}
+	other, _ := tenpu.CreateAttachment(&tenpuInput{FileName: "dog.png", ContentType: "image/png", OwnerId: "o1"}, m.blob, m.meta, strings.NewReader("woof"))
+
+	stored, _ := m.meta.AttachmentById(att.Id)
+	stored.Attrs["alt"] = "changed"
+	if again, _ := m.meta.AttachmentById(att.Id); again.Attrs["alt"] != "a cat" || again.Attrs["caption"] != "Tom" {
+		t.Errorf("%+v", again.Attrs)
+	}
+
+	input.attrs = map[string]string{"a.b": "x"}
+	if _, err = tenpu.CreateAttachment(input, m.blob, m.meta, strings.NewReader("bad")); !errors.Is(err, tenpu.ErrInvalid) {
+		t.Errorf("%+v", err)
+	}
+
+	cases := []struct {
+		q   tenpu.Query
+		ids []string
+	}{
+		{tenpu.Query{Tags: []string{"cats"}}, []string{att.Id}},
+		{tenpu.Query{Tags: []string{"cats", "dogs"}}, nil},
+		{tenpu.Query{Attrs: map[string]string{"caption": "Tom"}}, []string{att.Id}},
+		{tenpu.Query{Attrs: map[string]string{"caption": "Jerry"}}, nil},
+		{tenpu.Query{OwnerIds: []string{"o1"}}, []string{att.Id, other.Id}},
+	}
+	for i, c := range cases {
+		page, err := m.meta.QueryAttachments(&c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, a := range page.Attachments {
+			ids = append(ids, a.Id)
+		}
+		if strings.Join(ids, ",") != strings.Join(c.ids, ",") {
+			t.Errorf("%d: %+v", i, ids)
+		}
+	}
+
+	ts := httptest.NewServer(tenpu.MakeAPI(m, "/api/attachments"))
+	defer ts.Close()
+
+	do := func(method string, path string, body string) (status int, b string) {
+		req, _ := http.NewRequest(method, ts.URL+"/api/attachments"+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		bs, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(bs)
+	}
+
+	apiCases := []struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		contains string
+	}{
+		{"GET", "/" + att.Id, "", http.StatusOK, `"Attrs":{"alt":"a cat","caption":"Tom"},"Tags":["pets","cats"]`},
+		{"PATCH", "/" + other.Id, `{"Attrs":{"alt":"a dog"},"Tags":["pets","dogs"]}`, http.StatusOK, `"Tags":["pets","dogs"]`},
+		{"PATCH", "/" + other.Id, `{"Attrs":{"$where":"1"}}`, http.StatusBadRequest, `"Error"`},
+		{"GET", "?owner=o1&tag=pets&tag=dogs", "", http.StatusOK, other.Id},
+		{"GET", "?owner=o1&attr.alt=a+cat", "", http.StatusOK, att.Id},
+		{"GET", "?owner=o1&attr.alt=a+cow", "", http.StatusOK, `"Attachments":[]`},
+	}
+	for i, c := range apiCases {
+		status, body := do(c.method, c.path, c.body)
+		if status != c.status || !strings.Contains(body, c.contains) {
+			t.Errorf("%d: %s %s: %+v %s", i, c.method, c.path, status, body)
+		}
+	}
+}
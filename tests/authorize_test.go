@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theplant/tenpu"
+)
+
+// ownerOnly lets a request with the X-User header only touch the
+// attachments that user owns.
+func ownerOnly(r *http.Request, action tenpu.Action, att *tenpu.Attachment) (err error) {
+	if r.Header.Get("X-User") == "outage" {
+		return errors.New("authorizer backend is down")
+	}
+	if len(att.OwnerId) == 0 || att.OwnerId[0] != r.Header.Get("X-User") {
+		err = fmt.Errorf("%w: %s may not %s", tenpu.ErrForbidden, r.Header.Get("X-User"), action)
+	}
+	return
+}
+
+func TestMemstoreAuthorize(t *testing.T) {
+	mm := newMemMaker()
+	mm.readInput = func(r *http.Request, d *tenpuInput) tenpu.Input {
+		return &zipInput{*d, mm.meta}
+	}
+	m := &authorizer{mm, ownerOnly}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/postupload", tenpu.MakeUploader(m))
+	mux.HandleFunc("/load", tenpu.MakeFileLoader(m))
+	mux.HandleFunc("/zip", tenpu.MakeZipFileLoader(m))
+	mux.HandleFunc("/delete", tenpu.MakeDeleter(m))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	do := func(user string, method string, path string, body string) (status int, b string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("X-User", user)
+		if body != "" {
+			req.Header.Set("Content-Type", "multipart/form-data; boundary=----WebKitFormBoundarySHaDkk90eMKgsVUj")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		bs, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(bs)
+	}
+
+	owner := "4facead362911fa23c000001"
+	if status, body := do("intruder", "POST", "/postupload", multipartContent); status != http.StatusForbidden {
+		t.Errorf("%+v %s", status, body)
+	}
+	if status, body := do(owner, "POST", "/postupload", multipartContent); status != http.StatusOK {
+		t.Fatalf("%+v %s", status, body)
+	}
+	atts, _ := m.meta.Attachments(owner)
+	if len(atts) != 2 {
+		t.Fatalf("%+v", atts)
+	}
+
+	cases := []struct {
+		user   string
+		path   string
+		status int
+	}{
+		{owner, "/load?id=" + atts[0].Id, http.StatusOK},
+		{"intruder", "/load?id=" + atts[0].Id, http.StatusForbidden},
+		{"intruder", "/load?download=1&id=" + atts[0].Id, http.StatusForbidden},
+		{owner, "/zip?OwnerId=" + owner, http.StatusOK},
+		{"intruder", "/zip?OwnerId=" + owner, http.StatusForbidden},
+		{"intruder", "/delete?id=" + atts[0].Id, http.StatusForbidden},
+		{"outage", "/load?id=" + atts[0].Id, http.StatusInternalServerError},
+		{owner, "/delete?id=" + atts[0].Id, http.StatusOK},
+	}
+	for i, c := range cases {
+		if status, body := do(c.user, "GET", c.path, ""); status != c.status {
+			t.Errorf("%d: %s %s: %+v %s", i, c.user, c.path, status, body)
+		}
+	}
+}
+
+// countingInput counts the calls to SetAttrsForCreate.
+type countingInput struct {
+	tenpuInput
+	calls *int
+}
+
+func (d *countingInput) SetAttrsForCreate(att *tenpu.Attachment) (err error) {
+	*d.calls++
+	return d.tenpuInput.SetAttrsForCreate(att)
+}
+
+func TestMemstoreUploadWithoutAuthorizer(t *testing.T) {
+	var calls int
+	m := newMemMaker()
+	m.uploadInput = func(r *http.Request) tenpu.UploadInput {
+		return &countingInput{calls: &calls}
+	}
+
+	ts := httptest.NewServer(tenpu.MakeUploader(m))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL, "multipart/form-data; boundary=----WebKitFormBoundarySHaDkk90eMKgsVUj", strings.NewReader(multipartContent))
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("%+v", res.Status)
+	}
+	if atts, _ := m.meta.Attachments("4facead362911fa23c000001"); len(atts) != 2 || calls != 2 {
+		t.Errorf("%+v %+v", calls, atts)
+	}
+}
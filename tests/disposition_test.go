@@ -0,0 +1,35 @@
+package tests
+
+import (
+	"mime"
+	"testing"
+
+	"github.com/theplant/tenpu"
+)
+
+func TestContentDisposition(t *testing.T) {
+	cases := []struct {
+		disposition string
+		filename    string
+		header      string
+	}{
+		{tenpu.DispositionAttachment, "a.txt", `attachment; filename="a.txt"`},
+		{tenpu.DispositionInline, "my report, final.pdf", `inline; filename="my report, final.pdf"`},
+		{tenpu.DispositionAttachment, `a"; filename="evil.exe`, `attachment; filename="a_; filename=_evil.exe"; filename*=UTF-8''a%22%3B%20filename%3D%22evil.exe`},
+		{tenpu.DispositionAttachment, "日本語 報告.txt", `attachment; filename="___ __.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC%E8%AA%9E%20%E5%A0%B1%E5%91%8A.txt`},
+		{tenpu.DispositionInline, "", `inline`},
+	}
+
+	for _, c := range cases {
+		header := tenpu.ContentDisposition(c.disposition, c.filename)
+		if header != c.header {
+			t.Errorf("%q: %s", c.filename, header)
+		}
+
+		// mime prefers filename* and decodes it back
+		disposition, params, err := mime.ParseMediaType(header)
+		if err != nil || disposition != c.disposition || params["filename"] != c.filename {
+			t.Errorf("%q: %s %+v %+v", c.filename, disposition, params, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/extract"
+)
+
+func zipOf(files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func pdfOf(content string, compress bool) []byte {
+	stream, filter := []byte(content), ""
+	if compress {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(stream)
+		zw.Close()
+		stream, filter = buf.Bytes(), " /Filter /FlateDecode"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n4 0 obj\n<< /Length %d%s >>\nstream\n", len(stream), filter)
+	buf.Write(stream)
+	buf.WriteString("\nendstream\nendobj\n5 0 obj\n<< /Subtype /Image /Length 4 >>\nstream\n(no)\nendstream\nendobj\n%%EOF\n")
+	return buf.Bytes()
+}
+
+func TestExtractText(t *testing.T) {
+	e := &extract.Extractor{}
+
+	cases := []struct {
+		contentType string
+		filename    string
+		body        []byte
+		text        string
+	}{
+		{"text/plain; charset=utf-8", "a.txt", []byte("hello   world\n\n\tagain "), "hello world\nagain"},
+		{"", "a.txt", []byte("caf\xe9"), "café"},
+		{"text/csv", "a.csv", []byte("name,city\n\"Doe, Jane\",Tokyo\n"), "name city\nDoe, Jane Tokyo"},
+		{"application/json", "a.json", []byte(`{"b":["x",2],"a":{"c":"invoice"},"d":true}`), "invoice\nx\n2"},
+		{"text/html", "a.html", []byte(`<html><head><title>Report &amp; Co</title><style>p{}</style></head>` +
+			`<body><p>First<b>bold</b> line</p><!-- hidden --><script>var x = "<p>";</script><div>Second&nbsp;line</div></body></html>`),
+			"Report & Co\nFirst bold line\nSecond line"},
+		{"application/octet-stream", "a.docx", zipOf(map[string]string{
+			"word/document.xml": `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>Dear </w:t></w:r><w:r><w:t>customer</w:t></w:r></w:p>` +
+				`<w:p><w:r><w:t>Invoice</w:t><w:tab/><w:t>42</w:t></w:r></w:p></w:body></w:document>`,
+			"word/styles.xml": `<w:styles xmlns:w="w"><w:t>not text</w:t></w:styles>`,
+		}), "Dear customer\nInvoice 42"},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "a.xlsx", zipOf(map[string]string{
+			"xl/sharedStrings.xml":     `<sst><si><t>Total</t></si><si><r><t>Net</t></r><r><t>Sum</t></r></si></sst>`,
+			"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row><c t="inlineStr"><is><t>inline</t></is></c><c><v>12</v></c></row></sheetData></worksheet>`,
+		}), "Total\nNetSum\ninline"},
+		{"", "a.pptx", zipOf(map[string]string{
+			"ppt/slides/slide10.xml": `<p:sld><a:p><a:r><a:t>Ten</a:t></a:r></a:p></p:sld>`,
+			"ppt/slides/slide2.xml":  `<p:sld><a:p><a:r><a:t>Two</a:t></a:r></a:p></p:sld>`,
+		}), "Two\nTen"},
+		{"application/pdf", "a.pdf", pdfOf("BT /F1 12 Tf 72 712 Td (Hello \\(PDF\\)) Tj 0 -14 Td [(Wor) -10 (ld) -300 (again)] TJ ET", false), "Hello (PDF)\nWorld again"},
+		{"application/pdf", "a.pdf", pdfOf("BT /F1 12 Tf <FEFF00E9007400E9> Tj T* (caf\\351) Tj ET", true), "été\ncafé"},
+	}
+	for i, c := range cases {
+		text, err := e.Text(c.contentType, c.filename, c.body)
+		if err != nil || text != c.text {
+			t.Errorf("%d: %q %+v", i, text, err)
+		}
+	}
+
+	if _, err := e.Text("image/png", "a.png", []byte("png")); err == nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := (&extract.Extractor{MaxFileSize: 4}).Text("text/plain", "", []byte("too large")); err == nil {
+		t.Errorf("%+v", err)
+	}
+	if text, err := (&extract.Extractor{MaxTextLength: 8}).Text("text/plain", "", []byte("one two three")); err != nil || text != "one two" {
+		t.Errorf("%q %+v", text, err)
+	}
+}
+
+type extractMaker struct {
+	*memMaker
+	extract.Extractor
+}
+
+func TestExtractPostUpload(t *testing.T) {
+	m := &extractMaker{memMaker: newMemMaker()}
+	m.MaxFileSize = 50
+
+	ts := httptest.NewServer(tenpu.MakeUploader(m))
+	defer ts.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("OwnerId", "extract")
+	for _, name := range []string{"notes.txt", "big.txt", "logo.png"} {
+		fw, _ := mw.CreateFormFile("files", name)
+		fw.Write([]byte(map[string]string{"notes.txt": "the quarterly\ninvoice numbers", "big.txt": strings.Repeat("quarterly ", 10)}[name]))
+	}
+	mw.Close()
+
+	res, err := http.Post(ts.URL, mw.FormDataContentType(), &body)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("%+v", res.StatusCode)
+	}
+
+	atts, _ := m.meta.Attachments("extract")
+	if len(atts) != 3 {
+		t.Fatalf("%+v", atts)
+	}
+	for _, att := range atts {
+		if text := map[string]string{"notes.txt": "the quarterly\ninvoice numbers"}[att.Filename]; att.Text != text {
+			t.Errorf("%s: %q", att.Filename, att.Text)
+		}
+	}
+
+	r, err := tenpu.SearchAttachments(m.meta, &tenpu.Search{Text: "quarterly", OwnerIds: []string{"extract"}})
+	if err != nil || len(r.Hits) != 1 || r.Hits[0].Filename != "notes.txt" || r.Hits[0].Score != tenpu.TextWeight {
+		t.Errorf("%+v %+v", r, err)
+	}
+}
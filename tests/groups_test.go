@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theplant/tenpu"
+)
+
+type groupInput struct {
+	tenpuInput
+	groupId string
+}
+
+func (d *groupInput) GetGroupId() (groupId string) {
+	return d.groupId
+}
+
+func TestMemstoreGroups(t *testing.T) {
+	m := newMemMaker()
+	m.readInput = func(r *http.Request, d *tenpuInput) tenpu.Input {
+		return &groupInput{*d, r.FormValue("group")}
+	}
+
+	var ids []string
+	for i, content := range []string{"one", "two", "three"} {
+		att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "a.txt", ContentType: "text/plain", OwnerId: "o1"}, m.blob, m.meta, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			att.GroupId = []string{"other"}
+			m.meta.Put(att)
+		}
+		ids = append(ids, att.Id)
+	}
+
+	groupIds := func(groupId string) string {
+		atts, err := m.meta.AttachmentsByGroupId(groupId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r []string
+		for _, att := range atts {
+			r = append(r, att.Id)
+		}
+		return strings.Join(r, ",")
+	}
+
+	if changed, err := tenpu.AddToGroup(m.meta, "g1", ids...); err != nil || len(changed) != 3 {
+		t.Fatalf("%+v %+v", changed, err)
+	}
+	if changed, err := tenpu.AddToGroup(m.meta, "g1", ids[0]); err != nil || len(changed) != 0 {
+		t.Errorf("%+v %+v", changed, err)
+	}
+	if _, err := tenpu.AddToGroup(m.meta, "g1", "nope"); !errors.Is(err, tenpu.ErrNotFound) {
+		t.Errorf("%+v", err)
+	}
+	if g := groupIds("g1"); g != strings.Join(ids, ",") {
+		t.Errorf("%+v", g)
+	}
+
+	if _, err := tenpu.RemoveFromGroup(m.meta, "g1", ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if att, _ := m.meta.AttachmentById(ids[0]); strings.Join(att.GroupId, ",") != "other,g1" {
+		t.Errorf("%+v", att.GroupId)
+	}
+
+	if _, err := tenpu.RenameGroup(m.meta, "g1", "other"); !errors.Is(err, tenpu.ErrInvalid) {
+		t.Errorf("%+v", err)
+	}
+	if _, err := tenpu.RenameGroup(m.meta, "g1", "g2"); err != nil {
+		t.Fatal(err)
+	}
+	if g1, g2 := groupIds("g1"), groupIds("g2"); g1 != "" || g2 != ids[0]+","+ids[2] {
+		t.Errorf("%+v %+v", g1, g2)
+	}
+
+	if _, err := tenpu.MergeGroups(m.meta, "g2", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if att, _ := m.meta.AttachmentById(ids[0]); strings.Join(att.GroupId, ",") != "g2" {
+		t.Errorf("%+v", att.GroupId)
+	}
+
+	tenpu.DeleteAttachment(&tenpuInput{Id: ids[2]}, m.blob, m.meta)
+	stats, err := tenpu.CountGroups(m.meta, "g2", "none")
+	if err != nil || len(stats) != 2 || stats[0].Count != 1 || stats[0].Size != 3 || stats[1].Count != 0 {
+		t.Errorf("%+v %+v", stats, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/zip", tenpu.MakeGroupZipFileLoader(m))
+	mux.HandleFunc("/api/groups/", tenpu.MakeGroupAPI(m, "/api/groups"))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/zip?group=g2")
+	if err != nil {
+		panic(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Disposition") != `attachment; filename="g2.zip"` {
+		t.Errorf("%+v %+v", res.StatusCode, res.Header)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil || len(zr.File) != 1 {
+		t.Errorf("%+v", err)
+	}
+	for _, path := range []string{"/zip?group=none", "/zip"} {
+		res, _ = http.Get(ts.URL + path)
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			t.Errorf("%s: %+v", path, res.StatusCode)
+		}
+	}
+
+	patch := func(groupId string, body string) (status int, group tenpu.APIGroup) {
+		req, _ := http.NewRequest("PATCH", ts.URL+"/api/groups/"+groupId, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		json.NewDecoder(res.Body).Decode(&group)
+		res.Body.Close()
+		return res.StatusCode, group
+	}
+	if status, group := patch("g2", `{"Add":["`+ids[1]+`"],"Name":"packet"}`); status != http.StatusOK || group.GroupId != "packet" || group.Count != 2 || group.Size != 6 {
+		t.Errorf("%+v %+v", status, group)
+	}
+	if status, _ := patch("packet", `{"Add":["nope"]}`); status != http.StatusNotFound {
+		t.Errorf("%+v", status)
+	}
+	if status, _ := patch("packet", `{"Rename":"x"}`); status != http.StatusBadRequest {
+		t.Errorf("%+v", status)
+	}
+	if g := groupIds("g2"); g != "" {
+		t.Errorf("%+v", g)
+	}
+}
+
+func TestMemstoreGroupsKeepRevisions(t *testing.T) {
+	m := newMemMaker()
+	att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "v1.txt", ContentType: "text/plain", OwnerId: "o1"}, m.blob, m.meta, strings.NewReader("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another process stores a revision after each change reads the
+	// attachment
+	revision := 1
+	race := &raceMeta{MetaStorage: m.meta, race: func() {
+		stored, _ := m.meta.AttachmentById(att.Id)
+		stored.Revisions = append(stored.Revisions, &tenpu.Revision{Number: revision, BlobId: stored.Id})
+		revision++
+		stored.Revision = revision
+		m.meta.Put(stored)
+	}}
+	changes := []func() error{
+		func() (err error) {
+			_, err = tenpu.AddToGroup(race, "g1", att.Id)
+			return
+		},
+		func() (err error) {
+			_, _, err = tenpu.DeleteAttachment(&tenpuInput{Id: att.Id}, m.blob, race)
+			return
+		},
+		func() (err error) {
+			_, err = tenpu.RestoreAttachment(&tenpuInput{Id: att.Id}, race)
+			return
+		},
+	}
+	for i, change := range changes {
+		race.reads, race.at = 0, 1
+		if err = change(); err != nil {
+			t.Errorf("%d: %+v", i, err)
+		}
+	}
+
+	stored, _ := m.meta.AttachmentById(att.Id)
+	if stored.Revision != 4 || len(stored.Revisions) != 3 || len(stored.GroupId) != 1 || stored.Trashed() {
+		t.Errorf("%+v", stored)
+	}
+}
@@ -135,7 +135,7 @@ func TestUploader(t *testing.T) {
 		return
 	}
 
-	atts := meta.Attachments("4facead362911fa23c000001")
+	atts, _ := meta.Attachments("4facead362911fa23c000001")
 	if len(atts) != 2 {
 		t.Errorf("%+v", atts[0])
 	}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/localfs"
+)
+
+func TestLocalfsPutCopyDelete(t *testing.T) {
+	root, err := ioutil.TempDir("", "tenpu_localfs")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	storage := localfs.NewStorage(root)
+
+	att := &tenpu.Attachment{}
+	err = storage.Put("filea.txt", "text/plain", strings.NewReader("the file content a\n"), att)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(att.Id) != 24 || att.Filename != "filea.txt" || att.ContentLength != 19 {
+		t.Errorf("%+v", att)
+	}
+	if att.MD5 != "c07e44c6ec2d81bbe1ca81cced33ad63" {
+		t.Errorf("%+v", att.MD5)
+	}
+
+	var buf bytes.Buffer
+	if err = storage.Copy(att, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "the file content a\n" {
+		t.Errorf("%+v", buf.String())
+	}
+
+	f, err := storage.Open(att)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(9, io.SeekStart)
+	b, _ := ioutil.ReadAll(f)
+	if string(b) != "content a\n" {
+		t.Errorf("%+v", string(b))
+	}
+	f.Close()
+
+	if err = storage.Delete(att.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = storage.Copy(att, &buf); !errors.Is(err, tenpu.ErrNotFound) {
+		t.Errorf("%+v", err)
+	}
+	if err = storage.Delete(att.Id); !errors.Is(err, tenpu.ErrNotFound) {
+		t.Errorf("%+v", err)
+	}
+}
+
+func TestLocalfsImageSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "tenpu_localfs")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	tf, err := os.Open("t.jpg")
+	if err != nil {
+		panic(err)
+	}
+	defer tf.Close()
+
+	att := &tenpu.Attachment{}
+	err = localfs.NewStorage(root).Put("t.jpg", "image/jpeg", tf, att)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if att.Width == 0 || att.Height == 0 {
+		t.Errorf("%+v", att)
+	}
+}
@@ -0,0 +1,500 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/memstore"
+)
+
+// memMaker is the StorageMaker the memstore tests share. It reads a
+// tenpuInput from the form values, the hooks let a test hand out other
+// inputs or meta storages.
+type memMaker struct {
+	blob *memstore.BlobStorage
+	meta *memstore.MetaStorage
+	// readInput, when set, gives the input MakeForRead hands out in place
+	// of the tenpuInput read from the form values.
+	readInput func(r *http.Request, d *tenpuInput) tenpu.Input
+	// readMeta, when set, gives the meta storage MakeForRead hands out.
+	readMeta func(r *http.Request) (meta tenpu.MetaStorage, err error)
+	// uploadInput, when set, gives the input MakeForUpload hands out.
+	uploadInput func(r *http.Request) tenpu.UploadInput
+}
+
+func newMemMaker() *memMaker {
+	return &memMaker{
+		blob: memstore.NewBlobStorage(),
+		meta: memstore.NewMetaStorage(),
+	}
+}
+
+func (m *memMaker) MakeForRead(r *http.Request) (storage tenpu.BlobStorage, meta tenpu.MetaStorage, input tenpu.Input, err error) {
+	d := &tenpuInput{
+		Id:       r.FormValue("id"),
+		OwnerId:  r.FormValue("OwnerId"),
+		Thumb:    r.FormValue("thumb"),
+		Download: r.FormValue("download") != "",
+	}
+	storage, meta, input = m.blob, m.meta, d
+	if m.readInput != nil {
+		input = m.readInput(r, d)
+	}
+	if m.readMeta != nil {
+		meta, err = m.readMeta(r)
+	}
+	return
+}
+
+func (m *memMaker) MakeForUpload(r *http.Request) (storage tenpu.BlobStorage, meta tenpu.MetaStorage, input tenpu.UploadInput, err error) {
+	storage, meta, input = m.blob, m.meta, &tenpuInput{}
+	if m.uploadInput != nil {
+		input = m.uploadInput(r)
+	}
+	return
+}
+
+// authorizer is a memMaker with an Authorizer, the handlers find it with a
+// type assertion so it can not be one more hook.
+type authorizer struct {
+	*memMaker
+	authorize func(r *http.Request, action tenpu.Action, att *tenpu.Attachment) error
+}
+
+func (a *authorizer) Authorize(r *http.Request, action tenpu.Action, att *tenpu.Attachment) (err error) {
+	return a.authorize(r, action, att)
+}
+
+func TestMemstoreUploadLoadDelete(t *testing.T) {
+	m := newMemMaker()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/postupload", tenpu.MakeUploader(m))
+	mux.HandleFunc("/load", tenpu.MakeFileLoader(m))
+	mux.HandleFunc("/delete", tenpu.MakeDeleter(m))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/postupload", strings.NewReader(multipartContent))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=----WebKitFormBoundarySHaDkk90eMKgsVUj")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	if !strings.Contains(string(b), "4facead362911fa23c000001") {
+		t.Errorf("%+v", string(b))
+	}
+
+	atts, _ := m.meta.Attachments("4facead362911fa23c000001")
+	if len(atts) != 2 {
+		t.Fatalf("%+v", atts)
+	}
+	if c, err := m.meta.AttachmentsCountByOwnerIds([]string{"4facead362911fa23c000001", "other"}); err != nil || c != 2 {
+		t.Errorf("%+v", c)
+	}
+
+	res, err = http.Get(ts.URL + "/load?id=" + atts[1].Id)
+	if err != nil {
+		panic(err)
+	}
+	b, _ = ioutil.ReadAll(res.Body)
+	if string(b) != "the file content b\n" {
+		t.Errorf("%+v", string(b))
+	}
+	if cd := res.Header.Get("Content-Disposition"); cd != `inline; filename="fileb.txt"` {
+		t.Errorf("%+v", cd)
+	}
+
+	res, err = http.Get(ts.URL + "/load?download=1&id=" + atts[1].Id)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	if cd := res.Header.Get("Content-Disposition"); cd != `attachment; filename="fileb.txt"` {
+		t.Errorf("%+v", cd)
+	}
+
+	res, err = http.Get(ts.URL + "/delete?id=" + atts[0].Id)
+	if err != nil {
+		panic(err)
+	}
+	b, _ = ioutil.ReadAll(res.Body)
+	if !strings.Contains(string(b), `"Error":""`) {
+		t.Errorf("%+v", string(b))
+	}
+
+	if att, err := m.meta.AttachmentById(atts[0].Id); err != nil || !att.Trashed() {
+		t.Errorf("%+v", att)
+	}
+	if atts, err := m.meta.Attachments("4facead362911fa23c000001"); err != nil || len(atts) != 1 {
+		t.Errorf("%+v", atts)
+	}
+
+	res, err = http.Get(ts.URL + "/load?id=" + atts[0].Id)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("%+v", res.StatusCode)
+	}
+}
+
+func TestMemstoreConcurrentPut(t *testing.T) {
+	blob := memstore.NewBlobStorage()
+	meta := memstore.NewMetaStorage()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			att := &tenpu.Attachment{OwnerId: []string{"owner"}, GroupId: []string{"group"}}
+			err := blob.Put(fmt.Sprintf("file%d.txt", i), "text/plain", strings.NewReader("content"), att)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			meta.Put(att)
+		}(i)
+	}
+	wg.Wait()
+
+	if atts, err := meta.AttachmentsByOwnerIds([]string{"owner"}); err != nil || len(atts) != 50 {
+		t.Errorf("%+v", len(atts))
+	}
+	if atts, err := meta.AttachmentsByGroupId("group"); err != nil || len(atts) != 50 {
+		t.Errorf("%+v", len(atts))
+	}
+}
+
+func TestMemstoreRangeLoad(t *testing.T) {
+	m := newMemMaker()
+	att := &tenpu.Attachment{}
+	m.blob.Put("filea.txt", "text/plain", strings.NewReader("the file content a\n"), att)
+	m.meta.Put(att)
+
+	ts := httptest.NewServer(tenpu.MakeFileLoader(m))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/?id="+att.Id, nil)
+	req.Header.Set("Range", "bytes=4-7")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusPartialContent || string(b) != "file" {
+		t.Errorf("%+v %+v", res.StatusCode, string(b))
+	}
+	if res.Header.Get("Content-Range") != "bytes 4-7/19" || res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("%+v", res.Header)
+	}
+
+	req.Header.Set("Range", "bytes=0-2,9-15")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	b, _ = ioutil.ReadAll(res.Body)
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "multipart/byteranges") ||
+		!strings.Contains(string(b), "the") || !strings.Contains(string(b), "content") {
+		t.Errorf("%+v %+v", res.Header, string(b))
+	}
+
+	req.Header.Set("Range", "bytes=4-7")
+	req.Header.Set("If-Range", "Mon, 02 Jan 2006 15:04:05 GMT")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	b, _ = ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(b) != "the file content a\n" {
+		t.Errorf("%+v %+v", res.StatusCode, string(b))
+	}
+}
+
+func TestMemstoreConditionalLoad(t *testing.T) {
+	m := newMemMaker()
+	att := &tenpu.Attachment{UploadTime: time.Date(2014, 3, 1, 10, 0, 0, 0, time.UTC)}
+	m.blob.Put("filea.txt", "text/plain", strings.NewReader("the file content a\n"), att)
+	m.meta.Put(att)
+
+	ts := httptest.NewServer(tenpu.MakeFileLoader(m))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/?id=" + att.Id)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	if etag != `"c07e44c6ec2d81bbe1ca81cced33ad63"` || res.Header.Get("Last-Modified") != "Sat, 01 Mar 2014 10:00:00 GMT" {
+		t.Errorf("%+v", res.Header)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/?id="+att.Id, nil)
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("%+v", res.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", ts.URL+"/?id="+att.Id, nil)
+	req.Header.Set("If-Modified-Since", "Sun, 02 Mar 2014 10:00:00 GMT")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("%+v", res.StatusCode)
+	}
+
+	req.Header.Set("If-Modified-Since", "Fri, 28 Feb 2014 10:00:00 GMT")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("%+v", res.StatusCode)
+	}
+
+	// HEAD is answered from the meta alone
+	m.blob.Delete(att.Id)
+	res, err = http.Head(ts.URL + "/?id=" + att.Id)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode != http.StatusOK || res.ContentLength != 19 {
+		t.Errorf("%+v %+v", res.StatusCode, res.ContentLength)
+	}
+}
+
+func TestMemstoreDedup(t *testing.T) {
+	m := newMemMaker()
+
+	upload := func(owner string, content string) *tenpu.Attachment {
+		input := &tenpuInput{FileName: "logo.txt", ContentType: "text/plain", OwnerId: owner}
+		att, err := tenpu.CreateAttachment(input, m.blob, m.meta, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return att
+	}
+
+	a := upload("o1", "same logo")
+	b := upload("o2", "same logo")
+	c := upload("o3", "other logo")
+
+	if b.BodyId() != a.Id || c.BodyId() != c.Id {
+		t.Errorf("%+v %+v %+v", a, b, c)
+	}
+
+	del := func(att *tenpu.Attachment) {
+		trashed, deleted, err := tenpu.DeleteAttachment(&tenpuInput{Id: att.Id}, m.blob, m.meta)
+		if err != nil || !deleted {
+			t.Fatal(err)
+		}
+		if err = tenpu.PurgeAttachmentContext(context.Background(), m.blob, m.meta, trashed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	del(a)
+	var buf bytes.Buffer
+	if err := m.blob.Copy(b, &buf); err != nil || buf.String() != "same logo" {
+		t.Errorf("%+v %+v", err, buf.String())
+	}
+
+	del(b)
+	if err := m.blob.Copy(b, &buf); err == nil {
+		t.Errorf("blob of %+v should be deleted", b)
+	}
+
+	// a trashed attachment is about to lose its blob, it is not shared
+	d := upload("o4", "trashed logo")
+	if _, _, err := tenpu.DeleteAttachment(&tenpuInput{Id: d.Id}, m.blob, m.meta); err != nil {
+		t.Fatal(err)
+	}
+	if e := upload("o5", "trashed logo"); e.BodyId() != e.Id {
+		t.Errorf("%+v", e)
+	}
+
+	// an attachment with the MD5, but not the body, of an upload
+	forged := upload("o8", "forged logo")
+	sum := md5.Sum([]byte("genuine logo"))
+	forged.MD5 = hex.EncodeToString(sum[:])
+	if err := m.meta.Put(forged); err != nil {
+		t.Fatal(err)
+	}
+	if genuine := upload("o9", "genuine logo"); genuine.BodyId() != genuine.Id || genuine.MD5 != forged.MD5 {
+		t.Errorf("%+v %+v", genuine, forged)
+	}
+
+	// the attachment found is purged before the new one is stored
+	f := upload("o6", "purged logo")
+	meta := &purgingMeta{m.meta, m.blob}
+	g, err := tenpu.CreateAttachment(&tenpuInput{FileName: "logo.txt", ContentType: "text/plain", OwnerId: "o7"}, m.blob, meta, strings.NewReader("purged logo"))
+	if err != nil || g.BodyId() != g.Id {
+		t.Fatalf("%+v %+v", g, err)
+	}
+	if stored, _ := m.meta.AttachmentById(g.Id); stored == nil || stored.BlobId != "" {
+		t.Errorf("%+v", stored)
+	}
+	buf.Reset()
+	if err = m.blob.Copy(g, &buf); err != nil || buf.String() != "purged logo" {
+		t.Errorf("%+v %+v", err, buf.String())
+	}
+	if att, _ := m.meta.AttachmentById(f.Id); att != nil {
+		t.Errorf("%+v", att)
+	}
+}
+
+// purgingMeta purges the attachment AttachmentByContent finds, right after
+// finding it, as a concurrent purge of the trash could.
+type purgingMeta struct {
+	*memstore.MetaStorage
+	blob *memstore.BlobStorage
+}
+
+func (p *purgingMeta) AttachmentByContent(md5 string, contentLength int64) (r *tenpu.Attachment, err error) {
+	r, err = p.MetaStorage.AttachmentByContent(md5, contentLength)
+	if r != nil {
+		trashed := *r
+		trashed.DeletedAt = time.Now()
+		p.MetaStorage.Put(&trashed)
+		if err := tenpu.PurgeAttachmentContext(context.Background(), p.blob, p.MetaStorage, &trashed); err != nil {
+			panic(err)
+		}
+	}
+	return
+}
+
+// cancelReader cancels its context after the first read, like a client
+// going away in the middle of an upload.
+type cancelReader struct {
+	cancel func()
+	read   bool
+}
+
+func (r *cancelReader) Read(p []byte) (n int, err error) {
+	if r.read {
+		return len(p), nil
+	}
+	r.read = true
+	r.cancel()
+	return copy(p, "first chunk"), nil
+}
+
+func TestMemstoreCancelledUpload(t *testing.T) {
+	m := newMemMaker()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	input := &tenpuInput{FileName: "big.bin", ContentType: "application/octet-stream", OwnerId: "cancelled"}
+	_, err := tenpu.CreateAttachmentContext(ctx, input, m.blob, m.meta, &cancelReader{cancel: cancel})
+	if err != context.Canceled {
+		t.Errorf("%+v", err)
+	}
+	if atts, err := m.meta.Attachments("cancelled"); err != nil || len(atts) != 0 {
+		t.Errorf("%+v", atts)
+	}
+}
+
+// brokenMeta fails every lookup, like a database that can not be reached.
+type brokenMeta struct {
+	*memstore.MetaStorage
+}
+
+var errBroken = fmt.Errorf("connection refused")
+
+func (b *brokenMeta) AttachmentById(id string) (r *tenpu.Attachment, err error) {
+	err = errBroken
+	return
+}
+
+func TestMemstoreBrokenMeta(t *testing.T) {
+	m := newMemMaker()
+	m.readMeta = func(r *http.Request) (meta tenpu.MetaStorage, err error) {
+		if r.FormValue("session") == "lost" {
+			err = errBroken
+			return
+		}
+		meta = &brokenMeta{m.meta}
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/load", tenpu.MakeFileLoader(m))
+	mux.HandleFunc("/delete", tenpu.MakeDeleter(m))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, path := range []string{"/load?id=abc", "/delete?id=abc", "/load?id=abc&session=lost", "/delete?id=abc&session=lost"} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			panic(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusInternalServerError || !strings.Contains(string(b), "connection refused") {
+			t.Errorf("%s: %+v %s", path, res.Status, b)
+		}
+	}
+}
+
+// failingPutMeta can not store attachments.
+type failingPutMeta struct {
+	*memstore.MetaStorage
+}
+
+func (m *failingPutMeta) Put(att *tenpu.Attachment) (err error) {
+	err = errBroken
+	return
+}
+
+func TestMemstoreUploadRollback(t *testing.T) {
+	m := newMemMaker()
+
+	input := &tenpuInput{FileName: "a.txt", ContentType: "text/plain", OwnerId: "rollback"}
+	kept, err := tenpu.CreateAttachment(input, m.blob, m.meta, strings.NewReader("shared content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := &failingPutMeta{m.meta}
+	for _, content := range []string{"own content", "shared content"} {
+		att, err := tenpu.CreateAttachment(input, m.blob, failing, strings.NewReader(content))
+		if err != errBroken || att.Id == "" {
+			t.Fatalf("%+v %+v", att, err)
+		}
+		if _, err = m.blob.Open(att); !errors.Is(err, tenpu.ErrNotFound) && att.BlobId == "" {
+			t.Errorf("%s: blob of %+v is left: %+v", content, att, err)
+		}
+	}
+
+	// the blob deduplicated into is still there for its attachment
+	f, err := m.blob.Open(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if atts, err := m.meta.Attachments("rollback"); err != nil || len(atts) != 1 {
+		t.Errorf("%+v", atts)
+	}
+}
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/memstore"
+)
+
+func TestMemstoreQuery(t *testing.T) {
+	meta := memstore.NewMetaStorage()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"e.png", "d.txt", "c.png", "b.jpg", "a.png"} {
+		contentType := "image/png"
+		if strings.HasSuffix(name, ".txt") {
+			contentType = "text/plain"
+		}
+		if strings.HasSuffix(name, ".jpg") {
+			contentType = "image/jpeg"
+		}
+		meta.Put(&tenpu.Attachment{
+			Id:            strconv.Itoa(i),
+			OwnerId:       []string{"o1"},
+			Filename:      name,
+			ContentType:   contentType,
+			ContentLength: int64(100 * (5 - i)),
+			UploadTime:    start.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	meta.Put(&tenpu.Attachment{Id: "other", OwnerId: []string{"o2"}, Filename: "x.png", ContentType: "image/png"})
+	meta.Put(&tenpu.Attachment{Id: "trashed", OwnerId: []string{"o1"}, Filename: "t.png", ContentType: "image/png", DeletedAt: start})
+
+	all := func(q tenpu.Query) (ids []string) {
+		for i := 0; i < 10; i++ {
+			page, err := meta.QueryAttachments(&q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, att := range page.Attachments {
+				ids = append(ids, att.Id)
+			}
+			if page.NextCursor == "" {
+				return
+			}
+			q.Cursor = page.NextCursor
+		}
+		t.Fatalf("%+v: too many pages", q)
+		return
+	}
+
+	cases := []struct {
+		q   tenpu.Query
+		ids string
+	}{
+		{tenpu.Query{OwnerIds: []string{"o1"}, Limit: 2}, "0,1,2,3,4"},
+		{tenpu.Query{OwnerIds: []string{"o1"}, Limit: 2, Descending: true}, "4,3,2,1,0"},
+		{tenpu.Query{OwnerIds: []string{"o1"}, Limit: 3, Sort: tenpu.SortByName}, "4,3,2,1,0"},
+		{tenpu.Query{OwnerIds: []string{"o1"}, Limit: 1, Sort: tenpu.SortBySize, Descending: true}, "0,1,2,3,4"},
+		{tenpu.Query{OwnerIds: []string{"o1"}, ContentTypePrefix: "image/png"}, "0,2,4"},
+		{tenpu.Query{OwnerIds: []string{"o1"}, UploadedAfter: start.Add(time.Hour), UploadedBefore: start.Add(3 * time.Hour)}, "1,2"},
+		{tenpu.Query{OwnerIds: []string{"o1"}, MinSize: 200, MaxSize: 400, Limit: 1}, "1,2,3"},
+		{tenpu.Query{OwnerIds: []string{"o1", "o2"}, ContentTypePrefix: "image/", Sort: tenpu.SortByName, Limit: 2}, "4,3,2,0,other"},
+	}
+	for i, c := range cases {
+		if ids := strings.Join(all(c.q), ","); ids != c.ids {
+			t.Errorf("%d: %+v", i, ids)
+		}
+	}
+
+	page, _ := meta.QueryAttachments(&tenpu.Query{Limit: 2})
+	_, err := meta.QueryAttachments(&tenpu.Query{Limit: 2, Sort: tenpu.SortByName, Cursor: page.NextCursor})
+	if !errors.Is(err, tenpu.ErrInvalid) {
+		t.Errorf("%+v", err)
+	}
+	if _, err = meta.QueryAttachments(&tenpu.Query{Cursor: "nope"}); !errors.Is(err, tenpu.ErrInvalid) {
+		t.Errorf("%+v", err)
+	}
+	if _, err = meta.QueryAttachments(&tenpu.Query{Sort: "color"}); !errors.Is(err, tenpu.ErrInvalid) {
+		t.Errorf("%+v", err)
+	}
+
+	m := newMemMaker()
+	m.meta = meta
+	ts := httptest.NewServer(tenpu.MakeAPI(m, "/api/attachments"))
+	defer ts.Close()
+
+	var ids []string
+	path := "?owner=o1&type=image/&sort=size&order=desc&limit=2"
+	for path != "" {
+		res, err := http.Get(ts.URL + "/api/attachments" + path)
+		if err != nil {
+			panic(err)
+		}
+		var list tenpu.APIList
+		json.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || list.Count != 5 {
+			t.Fatalf("%s: %+v %+v", path, res.StatusCode, list)
+		}
+		for _, att := range list.Attachments {
+			ids = append(ids, att.Id)
+		}
+		path = ""
+		if list.NextCursor != "" {
+			path = "?owner=o1&type=image/&sort=size&order=desc&limit=2&cursor=" + list.NextCursor
+		}
+	}
+	if strings.Join(ids, ",") != "0,2,3,4" {
+		t.Errorf("%+v", ids)
+	}
+
+	for _, q := range []string{"order=up", "after=yesterday", "minsize=x", "limit=-1"} {
+		res, _ := http.Get(ts.URL + "/api/attachments?owner=o1&" + q)
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %+v", q, res.StatusCode)
+		}
+	}
+}
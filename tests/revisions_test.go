@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/memstore"
+)
+
+// revisionInput addresses a revision with the "revision" form value.
+type revisionInput struct {
+	tenpuInput
+	Revision int
+}
+
+func (d *revisionInput) GetRevision() (id string, revision int) {
+	return d.Id, d.Revision
+}
+
+func TestMemstoreRevisions(t *testing.T) {
+	m := newMemMaker()
+	m.readInput = func(r *http.Request, d *tenpuInput) tenpu.Input {
+		n, _ := strconv.Atoi(r.FormValue("revision"))
+		return &revisionInput{*d, n}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/load", tenpu.MakeFileLoader(m))
+	mux.HandleFunc("/revisions", tenpu.MakeRevisionLister(m))
+	mux.HandleFunc("/revert", tenpu.MakeReverter(m))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(path string) (status int, body string) {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			panic(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(b)
+	}
+
+	att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "v1.txt", ContentType: "text/plain", OwnerId: "doc"}, m.blob, m.meta, strings.NewReader("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstBlob := att.BodyId()
+	if _, err = tenpu.CreateAttachment(&tenpuInput{FileName: "copy.txt", OwnerId: "other"}, m.blob, m.meta, strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	input := &revisionInput{tenpuInput{Id: att.Id, FileName: "v2.txt", ContentType: "text/plain", OwnerId: "doc"}, 0}
+	if _, err = tenpu.CreateRevision(input, m.blob, m.meta, strings.NewReader("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	att, _ = m.meta.AttachmentById(att.Id)
+	if att.Revision != 2 || att.Filename != "v2.txt" || len(att.Revisions) != 1 || att.Revisions[0].BlobId != firstBlob {
+		t.Fatalf("%+v", att)
+	}
+
+	if status, body := get("/load?id=" + att.Id); status != http.StatusOK || body != "second" {
+		t.Errorf("%+v %s", status, body)
+	}
+	if status, body := get("/load?revision=1&id=" + att.Id); status != http.StatusOK || body != "first" {
+		t.Errorf("%+v %s", status, body)
+	}
+	if status, _ := get("/load?revision=5&id=" + att.Id); status != http.StatusNotFound {
+		t.Errorf("%+v", status)
+	}
+	if status, body := get("/revisions?id=" + att.Id); status != http.StatusOK || !strings.Contains(body, "v1.txt") || !strings.Contains(body, "v2.txt") {
+		t.Errorf("%+v %s", status, body)
+	}
+
+	if status, body := get("/revert?revision=1&id=" + att.Id); status != http.StatusOK {
+		t.Errorf("%+v %s", status, body)
+	}
+	if status, body := get("/load?id=" + att.Id); status != http.StatusOK || body != "first" {
+		t.Errorf("%+v %s", status, body)
+	}
+
+	// purging keeps the first blob, deduplicated into by the copy
+	att, _ = m.meta.AttachmentById(att.Id)
+	if att.Revision != 3 || len(att.BlobIds()) != 2 {
+		t.Fatalf("%+v", att)
+	}
+	if err = tenpu.PurgeAttachmentContext(context.Background(), m.blob, m.meta, att); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.blob.Open(att.AtRevision(2)); !errors.Is(err, tenpu.ErrNotFound) {
+		t.Errorf("%+v", err)
+	}
+	if f, err := m.blob.Open(att.AtRevision(1)); err != nil {
+		t.Errorf("%+v", err)
+	} else {
+		f.Close()
+	}
+}
+
+// racingRevisionInput stores another revision of the attachment while its
+// own one is being stored, once.
+type racingRevisionInput struct {
+	revisionInput
+	race func()
+}
+
+func (d *racingRevisionInput) SetAttrsForCreate(att *tenpu.Attachment) (err error) {
+	if d.race != nil {
+		d.race()
+		d.race = nil
+	}
+	return d.revisionInput.SetAttrsForCreate(att)
+}
+
+// plainMeta hides the optional interfaces of the MetaStorage it wraps.
+type plainMeta struct {
+	tenpu.MetaStorage
+}
+
+func TestMemstoreRevisionConflict(t *testing.T) {
+	for _, swapper := range []bool{true, false} {
+		m := newMemMaker()
+		var meta tenpu.MetaStorage = m.meta
+		if !swapper {
+			meta = &plainMeta{m.meta}
+		}
+
+		att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "v1.txt", ContentType: "text/plain", OwnerId: "doc"}, m.blob, meta, strings.NewReader("first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var uploaded []string
+		input := &racingRevisionInput{revisionInput{tenpuInput{Id: att.Id, FileName: "lost.txt", OwnerId: "doc"}, 0}, func() {
+			other := &revisionInput{tenpuInput{Id: att.Id, FileName: "v2.txt", OwnerId: "doc"}, 0}
+			if _, err := tenpu.CreateRevision(other, m.blob, meta, strings.NewReader("second")); err != nil {
+				t.Fatal(err)
+			}
+		}}
+		lost, err := tenpu.CreateRevision(input, &recordingBlob{m.blob, &uploaded}, meta, strings.NewReader("lost"))
+		if !errors.Is(err, tenpu.ErrConflict) || tenpu.StatusCode(err) != http.StatusConflict {
+			t.Errorf("%v: %+v %+v", swapper, lost, err)
+		}
+
+		att, _ = m.meta.AttachmentById(att.Id)
+		if att.Revision != 2 || att.Filename != "v2.txt" || len(att.Revisions) != 1 {
+			t.Errorf("%v: %+v", swapper, att)
+		}
+		// the blob of the losing revision is not left behind
+		if len(uploaded) != 1 {
+			t.Fatalf("%v: %+v", swapper, uploaded)
+		}
+		if _, err = m.blob.Open(&tenpu.Attachment{Id: uploaded[0]}); !errors.Is(err, tenpu.ErrNotFound) {
+			t.Errorf("%v: %+v", swapper, err)
+		}
+	}
+}
+
+// recordingBlob records the ids of the blobs put in it.
+type recordingBlob struct {
+	*memstore.BlobStorage
+	ids *[]string
+}
+
+func (b *recordingBlob) Put(filename string, contentType string, body io.Reader, att *tenpu.Attachment) (err error) {
+	if err = b.BlobStorage.Put(filename, contentType, body, att); err == nil {
+		*b.ids = append(*b.ids, att.BodyId())
+	}
+	return
+}
+
+// unstoringBlob fails every Put before giving the body an id, and records
+// the ids deleted from it.
+type unstoringBlob struct {
+	*memstore.BlobStorage
+	deleted *[]string
+}
+
+func (b *unstoringBlob) Put(filename string, contentType string, body io.Reader, att *tenpu.Attachment) (err error) {
+	err = errBroken
+	return
+}
+
+func (b *unstoringBlob) Delete(id string) (err error) {
+	*b.deleted = append(*b.deleted, id)
+	return b.BlobStorage.Delete(id)
+}
+
+func TestMemstoreRevisionFailedPut(t *testing.T) {
+	m := newMemMaker()
+	att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "v1.txt", ContentType: "text/plain", OwnerId: "doc"}, m.blob, m.meta, strings.NewReader("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted []string
+	input := &revisionInput{tenpuInput{Id: att.Id, FileName: "v2.txt", OwnerId: "doc"}, 0}
+	if _, err = tenpu.CreateRevision(input, &unstoringBlob{m.blob, &deleted}, m.meta, strings.NewReader("second")); !errors.Is(err, errBroken) {
+		t.Errorf("%+v", err)
+	}
+	// nothing was stored, so nothing is rolled back
+	if len(deleted) != 0 {
+		t.Errorf("%+v", deleted)
+	}
+}
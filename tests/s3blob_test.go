@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/s3blob"
+)
+
+// fakeS3 understands just enough of the S3 api for s3blob: object PUT, GET
+// and DELETE plus multipart uploads. With ignoreRange it answers ranged
+// GETs with the whole object, like servers without range support.
+type fakeS3 struct {
+	mutex       sync.Mutex
+	objects     map[string][]byte
+	uploads     map[string]map[int][]byte
+	parts       int
+	ignoreRange bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AK/") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>AccessDenied</Code><Message>no signature</Message></Error>")
+		return
+	}
+
+	key := r.URL.Path
+	q := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	_, initiate := q["uploads"]
+
+	switch {
+	case r.Method == "POST" && initiate:
+		uploadId := fmt.Sprintf("upload%d", len(f.uploads)+1)
+		f.uploads[uploadId] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, uploadId)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.uploads[q.Get("uploadId")][n] = body
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"etag%d"`, n))
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		parts := f.uploads[q.Get("uploadId")]
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var obj []byte
+		for _, n := range numbers {
+			obj = append(obj, parts[n]...)
+		}
+		f.objects[key] = obj
+		delete(f.uploads, q.Get("uploadId"))
+		var c struct{ Part []struct{ ETag string } }
+		xml.Unmarshal(body, &c)
+		if len(c.Part) != len(numbers) {
+			fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>parts mismatch</Message></Error>")
+			return
+		}
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "PUT":
+		f.objects[key] = body
+	case r.Method == "GET" || r.Method == "HEAD":
+		obj, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+			return
+		}
+		var from int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &from); err == nil && !f.ignoreRange {
+			obj = obj[from:]
+			w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+		}
+		if r.Method == "GET" {
+			w.Write(obj)
+		}
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3blobPutCopyDelete(t *testing.T) {
+	fake := newFakeS3()
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	storage := s3blob.NewStorage(&s3blob.Configuration{
+		Endpoint:  ts.URL,
+		Bucket:    "bucket",
+		Prefix:    "tenpu/",
+		AccessKey: "AK",
+		SecretKey: "SK",
+	})
+
+	att := &tenpu.Attachment{}
+	err := storage.Put("filea.txt", "text/plain", strings.NewReader("the file content a\n"), att)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if att.MD5 != "c07e44c6ec2d81bbe1ca81cced33ad63" || att.ContentLength != 19 || att.Filename != "filea.txt" {
+		t.Errorf("%+v", att)
+	}
+	if _, ok := fake.objects["/bucket/tenpu/"+att.Id]; !ok {
+		t.Errorf("%+v", fake.objects)
+	}
+
+	var buf bytes.Buffer
+	if err = storage.Copy(att, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "the file content a\n" {
+		t.Errorf("%+v", buf.String())
+	}
+
+	f, err := storage.Open(att)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(9, io.SeekStart)
+	b, _ := ioutil.ReadAll(f)
+	if string(b) != "content a\n" {
+		t.Errorf("%+v", string(b))
+	}
+	f.Seek(-2, io.SeekEnd)
+	b, _ = ioutil.ReadAll(f)
+	if string(b) != "a\n" {
+		t.Errorf("%+v", string(b))
+	}
+
+	fake.ignoreRange = true
+	f.Seek(4, io.SeekStart)
+	b, _ = ioutil.ReadAll(f)
+	if string(b) != "file content a\n" {
+		t.Errorf("%+v", string(b))
+	}
+	fake.ignoreRange = false
+	f.Close()
+
+	if err = storage.Delete(att.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.Open(att); !errors.Is(err, tenpu.ErrNotFound) {
+		t.Errorf("%+v", err)
+	}
+	if err = storage.Copy(att, &buf); !errors.Is(err, tenpu.ErrNotFound) {
+		t.Errorf("%+v", err)
+	}
+}
+
+func TestS3blobMultipart(t *testing.T) {
+	fake := newFakeS3()
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	storage := s3blob.NewStorage(&s3blob.Configuration{
+		Endpoint:  ts.URL,
+		Bucket:    "bucket",
+		AccessKey: "AK",
+		SecretKey: "SK",
+		// raised to s3blob.MinPartSize
+		PartSize: 1024,
+	})
+
+	tf, err := os.Open("t.jpg")
+	if err != nil {
+		panic(err)
+	}
+	defer tf.Close()
+	content, _ := ioutil.ReadAll(tf)
+	content = append(content, make([]byte, 2*s3blob.MinPartSize)...)
+
+	att := &tenpu.Attachment{}
+	err = storage.Put("t.jpg", "image/jpeg", bytes.NewReader(content), att)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := md5.Sum(content)
+	if att.MD5 != hex.EncodeToString(sum[:]) || att.ContentLength != int64(len(content)) {
+		t.Errorf("%+v", att)
+	}
+	if att.Width == 0 || att.Height == 0 {
+		t.Errorf("%+v", att)
+	}
+	if fake.parts != 3 {
+		t.Errorf("%+v", fake.parts)
+	}
+	if !bytes.Equal(fake.objects["/bucket/"+att.Id], content) {
+		t.Errorf("object content mismatch")
+	}
+}
+
+func TestS3blobError(t *testing.T) {
+	ts := httptest.NewServer(newFakeS3())
+	defer ts.Close()
+
+	storage := s3blob.NewStorage(&s3blob.Configuration{
+		Endpoint: ts.URL,
+		Bucket:   "bucket",
+	})
+
+	err := storage.Put("filea.txt", "text/plain", strings.NewReader("a"), &tenpu.Attachment{})
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("%+v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/tenpu"
+)
+
+func TestMemstoreSearch(t *testing.T) {
+	m := newMemMaker()
+
+	put := func(id string, owner string, filename string, category string, tags []string, attrs map[string]string, hour int) {
+		m.meta.Put(&tenpu.Attachment{Id: id, OwnerId: []string{owner}, Filename: filename, Category: category,
+			Tags: tags, Attrs: attrs, UploadTime: time.Date(2020, 1, 1, hour, 0, 0, 0, time.UTC)})
+	}
+	put("inv1", "o1", "Invoice-2020-03.pdf", "billing", nil, nil, 1)
+	put("inv2", "o1", "scan.pdf", "", []string{"invoice"}, nil, 2)
+	put("inv3", "o1", "old-invoices.zip", "", nil, nil, 3)
+	put("note", "o1", "notes.txt", "", nil, map[string]string{"caption": "about the invoice"}, 4)
+	put("other", "o2", "invoice.pdf", "", nil, nil, 5)
+	put("none", "o1", "cat.png", "", nil, nil, 6)
+
+	ids := func(r *tenpu.SearchResult) string {
+		var ids []string
+		for _, hit := range r.Hits {
+			ids = append(ids, hit.Id)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	r, err := tenpu.SearchAttachments(m.meta, &tenpu.Search{Text: "invoice billing", OwnerIds: []string{"o1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids(r) != "inv1,inv3,inv2,note" || r.Hits[0].Score != 13 || r.NextCursor != "" {
+		t.Errorf("%+v", ids(r))
+	}
+
+	var all []string
+	s := &tenpu.Search{Text: "INVOICE", OwnerIds: []string{"o1", "o2"}, Limit: 2}
+	for i := 0; i < 5; i++ {
+		if r, err = tenpu.SearchAttachments(m.meta, s); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, ids(r))
+		if r.NextCursor == "" {
+			break
+		}
+		s.Cursor = r.NextCursor
+	}
+	if strings.Join(all, "|") != "other,inv3|inv1,inv2|note" {
+		t.Errorf("%+v", all)
+	}
+
+	for _, s := range []*tenpu.Search{
+		{Text: " - ", OwnerIds: []string{"o1"}},
+		{Text: "invoice"},
+		{Text: "invoice", OwnerIds: []string{"o1"}, Cursor: "x"},
+	} {
+		if _, err = tenpu.SearchAttachments(m.meta, s); !errors.Is(err, tenpu.ErrInvalid) {
+			t.Errorf("%+v: %+v", s, err)
+		}
+	}
+
+	ts := httptest.NewServer(tenpu.MakeSearchAPI(m))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?q=invoice-2020&owner=o1&limit=1")
+	if err != nil {
+		panic(err)
+	}
+	var result tenpu.SearchResult
+	json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || len(result.Hits) != 1 || result.Hits[0].Id != "inv1" || result.Hits[0].Score != 20 || result.NextCursor != "1" {
+		t.Errorf("%+v %+v", res.StatusCode, result)
+	}
+
+	res, _ = http.Get(ts.URL + "?q=invoice")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("%+v", res.StatusCode)
+	}
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/tenpu"
+)
+
+func TestMemstoreSignedLoad(t *testing.T) {
+	m := newMemMaker()
+	att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "a.txt", ContentType: "text/plain", OwnerId: "signed"}, m.blob, m.meta, strings.NewReader("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey := &tenpu.SigningKey{Id: "k1", Secret: []byte("old secret")}
+	newKey := &tenpu.SigningKey{Id: "k2", Secret: []byte("new secret")}
+	signer := &tenpu.Signer{Keys: []*tenpu.SigningKey{oldKey}}
+
+	ts := httptest.NewServer(tenpu.MakeSignedFileLoader(m, &tenpu.Signer{Keys: []*tenpu.SigningKey{newKey, oldKey}}))
+	defer ts.Close()
+
+	get := func(query string) int {
+		res, err := http.Get(ts.URL + "/load?" + query)
+		if err != nil {
+			panic(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	sign := func(s *tenpu.Signer, id string, download bool, expires time.Time) string {
+		q, err := s.Sign([]string{id}, "", download, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q.Encode()
+	}
+	later := time.Now().Add(time.Hour)
+
+	// signed before the rotation
+	if status := get("id=" + att.Id + "&" + sign(signer, att.Id, false, later)); status != http.StatusOK {
+		t.Errorf("%+v", status)
+	}
+
+	signer.Keys = []*tenpu.SigningKey{newKey, oldKey}
+	cases := []struct {
+		query  string
+		status int
+	}{
+		{"id=" + att.Id + "&" + sign(signer, att.Id, false, later), http.StatusOK},
+		{"id=" + att.Id + "&download=1&" + sign(signer, att.Id, true, later), http.StatusOK},
+		{"id=" + att.Id, http.StatusForbidden},
+		{"id=" + att.Id + "&download=1&" + sign(signer, att.Id, false, later), http.StatusForbidden},
+		{"id=" + att.Id + "&" + sign(signer, "other", false, later), http.StatusForbidden},
+		{"id=" + att.Id + "&" + sign(signer, att.Id, false, time.Now().Add(-time.Minute)), http.StatusForbidden},
+		{"id=" + att.Id + "&" + sign(&tenpu.Signer{Keys: []*tenpu.SigningKey{{Id: "k2", Secret: []byte("guess")}}}, att.Id, false, later), http.StatusForbidden},
+	}
+	for i, c := range cases {
+		if status := get(c.query); status != c.status {
+			t.Errorf("%d: %s: %+v", i, c.query, status)
+		}
+	}
+}
+
+func TestMemstoreSignedRevision(t *testing.T) {
+	m := newMemMaker()
+	m.readInput = func(r *http.Request, d *tenpuInput) tenpu.Input {
+		n, _ := strconv.Atoi(r.FormValue("revision"))
+		return &revisionInput{*d, n}
+	}
+	att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "a.txt", ContentType: "text/plain", OwnerId: "signed"}, m.blob, m.meta, strings.NewReader("old secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tenpu.CreateRevision(&revisionInput{tenpuInput{Id: att.Id, FileName: "a.txt", OwnerId: "signed"}, 0}, m.blob, m.meta, strings.NewReader("new secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	signer := &tenpu.Signer{Keys: []*tenpu.SigningKey{{Id: "k1", Secret: []byte("secret")}}}
+	ts := httptest.NewServer(tenpu.MakeSignedFileLoader(m, signer))
+	defer ts.Close()
+
+	later := time.Now().Add(time.Hour)
+	current, _ := signer.Sign([]string{att.Id}, "", false, later)
+	first, _ := signer.SignRevision(att.Id, 1, "", false, later)
+	cases := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"id=" + att.Id + "&" + current.Encode(), http.StatusOK, "new secret"},
+		{"id=" + att.Id + "&revision=1&" + current.Encode(), http.StatusForbidden, ""},
+		{"id=" + att.Id + "&revision=1&" + first.Encode(), http.StatusOK, "old secret"},
+		{"id=" + att.Id + "&revision=2&" + first.Encode(), http.StatusForbidden, ""},
+		{"id=" + att.Id + "&" + first.Encode(), http.StatusForbidden, ""},
+	}
+	for i, c := range cases {
+		res, err := http.Get(ts.URL + "/load?" + c.query)
+		if err != nil {
+			panic(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != c.status || (c.body != "" && string(b) != c.body) {
+			t.Errorf("%d: %s: %+v %s", i, c.query, res.StatusCode, b)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/sqlmeta"
+)
+
+var _ tenpu.MetaStorageContext = &sqlmeta.Storage{}
+var _ tenpu.GroupCounter = &sqlmeta.Storage{}
+
+func newSqlmeta(t *testing.T) (s *sqlmeta.Storage, db *sql.DB) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		panic(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	s = sqlmeta.NewStorage(db, "", sqlmeta.QuestionMark)
+	if err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// running it again must be a no-op
+	if err = s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSqlmetaLookups(t *testing.T) {
+	s, db := newSqlmeta(t)
+	defer db.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	atts := []*tenpu.Attachment{
+		{Id: "a1", OwnerId: []string{"o1", "o2"}, GroupId: []string{"g1"}, Filename: "a.txt", ContentLength: 10, UploadTime: now},
+		{Id: "a2", OwnerId: []string{"o1"}, Filename: "b.jpg", ContentType: "image/jpeg", Width: 3, Height: 4, UploadTime: now.Add(time.Second)},
+		{Id: "a3", OwnerId: []string{"o3"}, GroupId: []string{"g2", "g1"}, Filename: "c.txt", UploadTime: now.Add(2 * time.Second)},
+	}
+	for _, att := range atts {
+		if err := s.Put(att); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r, err := s.Attachments("o1"); err != nil || len(r) != 2 || r[0].Id != "a1" || r[1].Id != "a2" {
+		t.Errorf("%+v", r)
+	}
+	if r, err := s.AttachmentsByOwnerIds([]string{"o2", "o3"}); err != nil || len(r) != 2 {
+		t.Errorf("%+v", r)
+	}
+	if c, err := s.AttachmentsCountByOwnerIds([]string{"o1", "o2"}); err != nil || c != 2 {
+		t.Errorf("%+v", c)
+	}
+	if r, err := s.AttachmentByIds([]string{"a1", "a3", "nope"}); err != nil || len(r) != 2 {
+		t.Errorf("%+v", r)
+	}
+	if r, err := s.AttachmentsByGroupId("g2"); err != nil || len(r) != 1 || r[0].Id != "a3" {
+		t.Errorf("%+v", r)
+	}
+	if r, err := s.AttachmentsByGroupId("g1"); err != nil || len(r) != 2 {
+		t.Errorf("%+v", r)
+	}
+	if r, err := s.GroupStats([]string{"g1", "g3"}); err != nil || len(r) != 2 || r[0].Count != 2 || r[0].Size != 10 || r[1].GroupId != "g3" || r[1].Count != 0 {
+		t.Errorf("%+v %+v", r, err)
+	}
+
+	r, _ := s.AttachmentById("a1")
+	if r == nil || len(r.OwnerId) != 2 || r.OwnerId[1] != "o2" || r.ContentLength != 10 || !r.UploadTime.Equal(now) {
+		t.Fatalf("%+v", r)
+	}
+	if r, err := s.AttachmentById("a2"); err != nil || r.Width != 3 || r.Height != 4 {
+		t.Errorf("%+v", r)
+	}
+
+	r.OwnerId = []string{"o3"}
+	if err := s.Put(r); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.Attachments("o3"); err != nil || len(r) != 2 {
+		t.Errorf("%+v", r)
+	}
+	if r, err := s.Attachments("o2"); err != nil || len(r) != 0 {
+		t.Errorf("%+v", r)
+	}
+
+	if err := s.Remove("a3"); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.AttachmentById("a3"); err != nil || r != nil {
+		t.Errorf("%+v", r)
+	}
+	if r, err := s.AttachmentsByGroupId("g2"); err != nil || len(r) != 0 {
+		t.Errorf("%+v", r)
+	}
+}
+
+func TestSqlmetaTrash(t *testing.T) {
+	s, db := newSqlmeta(t)
+	defer db.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	atts := []*tenpu.Attachment{
+		{Id: "live", OwnerId: []string{"o1"}, GroupId: []string{"g1"}, UploadTime: now},
+		{Id: "old", OwnerId: []string{"o1"}, GroupId: []string{"g1"}, UploadTime: now, DeletedAt: now.Add(-2 * time.Hour)},
+		{Id: "new", OwnerId: []string{"o1"}, UploadTime: now, DeletedAt: now},
+	}
+	for _, att := range atts {
+		if err := s.Put(att); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r, err := s.Attachments("o1"); err != nil || len(r) != 1 || r[0].Id != "live" {
+		t.Errorf("%+v", r)
+	}
+	if c, err := s.AttachmentsCountByOwnerIds([]string{"o1"}); err != nil || c != 1 {
+		t.Errorf("%+v", c)
+	}
+	if r, err := s.AttachmentByIds([]string{"live", "old"}); err != nil || len(r) != 1 {
+		t.Errorf("%+v", r)
+	}
+	if r, err := s.AttachmentById("new"); err != nil || !r.DeletedAt.Equal(now) {
+		t.Errorf("%+v", r)
+	}
+	if r, err := s.AttachmentById("live"); err != nil || r.Trashed() {
+		t.Errorf("%+v", r)
+	}
+
+	if r, err := s.TrashedAttachments(now.Add(-time.Hour)); err != nil || len(r) != 1 || r[0].Id != "old" {
+		t.Errorf("%+v", r)
+	}
+}
+
+func TestSqlmetaRevisions(t *testing.T) {
+	s, db := newSqlmeta(t)
+	defer db.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	att := &tenpu.Attachment{Id: "a1", BlobId: "b2", Filename: "v2.txt", UploadTime: now, UploadedBy: "bob", Revision: 2,
+		Revisions: []*tenpu.Revision{{Number: 1, BlobId: "a1", Filename: "v1.txt", MD5: "m1", ContentLength: 3, UploadTime: now.Add(-time.Hour), UploadedBy: "alice"}},
+	}
+	if err := s.Put(att); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.AttachmentById("a1")
+	if err != nil || r.Revision != 2 || r.UploadedBy != "bob" || len(r.Revisions) != 1 {
+		t.Fatalf("%+v %+v", r, err)
+	}
+	if rev := r.Revisions[0]; rev.Filename != "v1.txt" || rev.BlobId != "a1" || rev.UploadedBy != "alice" || !rev.UploadTime.Equal(now.Add(-time.Hour)) {
+		t.Errorf("%+v", rev)
+	}
+
+	for _, blobId := range []string{"a1", "b2"} {
+		if c, err := s.AttachmentsCountByBlobId(blobId); err != nil || c != 1 {
+			t.Errorf("%s: %+v %+v", blobId, c, err)
+		}
+	}
+
+	if err = s.Remove("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.AttachmentsCountByBlobId("a1"); err != nil || c != 0 {
+		t.Errorf("%+v %+v", c, err)
+	}
+}
+
+func TestSqlmetaAttrs(t *testing.T) {
+	s, db := newSqlmeta(t)
+	defer db.Close()
+
+	att := &tenpu.Attachment{Id: "a1", Filename: "a.txt", UploadTime: time.Now(),
+		Attrs: map[string]string{"alt": "text", "caption": ""}, Tags: []string{"b", "a"}, Text: "body text"}
+	if err := s.Put(att); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.AttachmentById("a1")
+	if err != nil || len(r.Attrs) != 2 || r.Attrs["alt"] != "text" || strings.Join(r.Tags, ",") != "b,a" || r.Text != "body text" {
+		t.Fatalf("%+v %+v", r, err)
+	}
+
+	r.Attrs, r.Tags = nil, []string{"c"}
+	if err = s.Put(r); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = s.AttachmentById("a1"); err != nil || r.Attrs != nil || strings.Join(r.Tags, ",") != "c" {
+		t.Errorf("%+v %+v", r, err)
+	}
+}
+
+func TestSqlmetaManyAttachments(t *testing.T) {
+	s, db := newSqlmeta(t)
+	defer db.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	var ids []string
+	for i := 0; i < 1200; i++ {
+		att := &tenpu.Attachment{Id: fmt.Sprintf("a%04d", i), OwnerId: []string{"o1", "o1"}, GroupId: []string{"g1", "g1"},
+			Tags: []string{"t", "t"}, Attrs: map[string]string{"n": "v"}, UploadTime: now.Add(time.Duration(i) * time.Second)}
+		if err := s.Put(att); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, att.Id)
+	}
+
+	r, err := s.Attachments("o1")
+	if err != nil || len(r) != 1200 || r[1199].Id != "a1199" || len(r[0].OwnerId) != 1 || len(r[0].Tags) != 1 || r[0].Attrs["n"] != "v" {
+		t.Fatalf("%d %+v", len(r), err)
+	}
+	if r, err = s.AttachmentByIds(ids); err != nil || len(r) != 1200 || r[0].Id != "a0000" || r[1199].Id != "a1199" || len(r[600].GroupId) != 1 {
+		t.Errorf("%d %+v", len(r), err)
+	}
+
+	// owners in different chunks, the attachment of both is read once
+	if err = s.Put(&tenpu.Attachment{Id: "b", OwnerId: []string{"o1", "o2"}, UploadTime: now.Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	ownerids := []string{"o1"}
+	for i := 0; i < 1200; i++ {
+		ownerids = append(ownerids, fmt.Sprintf("x%04d", i))
+	}
+	ownerids = append(ownerids, "o2")
+	if r, err = s.AttachmentsByOwnerIds(ownerids); err != nil || len(r) != 1201 || r[0].Id != "b" || r[1200].Id != "a1199" {
+		t.Errorf("%d %+v", len(r), err)
+	}
+	if n, err := s.AttachmentsCountByOwnerIds(ownerids); err != nil || n != 1201 {
+		t.Errorf("%d %+v", n, err)
+	}
+}
+
+func TestSqlmetaSwapRevision(t *testing.T) {
+	s, db := newSqlmeta(t)
+	defer db.Close()
+
+	var _ tenpu.RevisionSwapper = s
+	att := &tenpu.Attachment{Id: "a1", OwnerId: []string{"o1"}, Filename: "v1.txt", Revision: 1, UploadTime: time.Now()}
+	if err := s.Put(att); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	att.Filename, att.Revision = "v2.txt", 2
+	if swapped, err := s.SwapRevision(ctx, att, 1); err != nil || !swapped {
+		t.Fatalf("%+v %+v", swapped, err)
+	}
+	att.Filename, att.Revision = "lost.txt", 2
+	if swapped, err := s.SwapRevision(ctx, att, 1); err != nil || swapped {
+		t.Errorf("%+v %+v", swapped, err)
+	}
+	// a change that keeps the revision
+	att.Filename = "renamed.txt"
+	if swapped, err := s.SwapRevision(ctx, att, 2); err != nil || !swapped {
+		t.Errorf("%+v %+v", swapped, err)
+	}
+	if r, err := s.AttachmentById("a1"); err != nil || r.Filename != "renamed.txt" || r.Revision != 2 || len(r.OwnerId) != 1 {
+		t.Errorf("%+v %+v", r, err)
+	}
+}
+
+func TestSqlmetaContent(t *testing.T) {
+	s, db := newSqlmeta(t)
+	defer db.Close()
+
+	now := time.Now()
+	atts := []*tenpu.Attachment{
+		{Id: "forged", MD5: "m1", SHA256: "s0", ContentLength: 4, UploadTime: now},
+		{Id: "live", MD5: "m1", SHA256: "s1", ContentLength: 4, UploadTime: now,
+			Revision: 2, Revisions: []*tenpu.Revision{{Number: 1, BlobId: "live", SHA256: "s9", UploadTime: now}}},
+		{Id: "trashed", MD5: "m2", SHA256: "s2", ContentLength: 4, UploadTime: now, DeletedAt: now},
+	}
+	for _, att := range atts {
+		if err := s.Put(att); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r, err := s.AttachmentByContent("s1", 4); err != nil || r == nil || r.Id != "live" || r.Revisions[0].SHA256 != "s9" {
+		t.Errorf("%+v %+v", r, err)
+	}
+	for _, sha := range []string{"s2", "s9", "m1"} {
+		if r, err := s.AttachmentByContent(sha, 4); err != nil || r != nil {
+			t.Errorf("%s: %+v %+v", sha, r, err)
+		}
+	}
+}
@@ -22,7 +22,7 @@ var thumbnailsCollectionName = "thumbnails"
 type ThumbnailStorageMaker struct {
 }
 
-func (m *ThumbnailStorageMaker) Make(r *http.Request) (storage *thumbnails.Storage, err error) {
+func (m *ThumbnailStorageMaker) Make(r *http.Request) (storage thumbnails.ThumbnailStorage, err error) {
 	db := mgodb.NewDatabase("localhost", "tenpu_test")
 	storage = thumbnails.NewStorage(db, "thumbnails")
 	return
@@ -72,7 +72,7 @@ func TestThumbnailLoader(t *testing.T) {
 		t.Errorf("%+v", strb)
 	}
 
-	atts := meta.Attachments("my12345")
+	atts, _ := meta.Attachments("my12345")
 	if len(atts) != 1 {
 		t.Errorf("%+v", atts)
 	}
@@ -99,3 +99,114 @@ func TestThumbnailLoader(t *testing.T) {
 		t.Errorf("%+v", thumbs)
 	}
 }
+
+type memThumbnailStorageMaker struct {
+	storage *thumbnails.MemStorage
+}
+
+func (m *memThumbnailStorageMaker) Make(r *http.Request) (storage thumbnails.ThumbnailStorage, err error) {
+	storage = m.storage
+	return
+}
+
+func TestMemstoreThumbnailLoader(t *testing.T) {
+	m := newMemMaker()
+	thumbs := &memThumbnailStorageMaker{thumbnails.NewMemStorage()}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/thumbload", thumbnails.MakeLoader(&thumbnails.Configuration{
+		Maker:                 m,
+		ThumbnailStorageMaker: thumbs,
+		ThumbnailSpecs: []*thumbnails.ThumbnailSpec{
+			{Name: "icon", Width: 100},
+		},
+		DefaultThumbnails: []string{"t.jpg", "t.jpg", "t.jpg", "t.jpg"},
+	}))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tf, err := os.Open("t.jpg")
+	if err != nil {
+		panic(err)
+	}
+	defer tf.Close()
+	att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "t.jpg", ContentType: "image/jpeg", OwnerId: "thumbowner"}, m.blob, m.meta, tf)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// a HEAD does not make the thumbnail
+	res, err := http.Head(ts.URL + fmt.Sprintf("/thumbload?id=%s&thumb=icon", att.Id))
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/jpeg" || res.Header.Get("ETag") != "" {
+		t.Errorf("%+v %+v", res.StatusCode, res.Header)
+	}
+	if made, _ := thumbs.storage.ThumbnailByParentId(att.Id); len(made) != 0 {
+		t.Errorf("%+v", made)
+	}
+
+	var etag string
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(ts.URL + fmt.Sprintf("/thumbload?id=%s&thumb=icon", att.Id))
+		if err != nil {
+			panic(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/jpeg" || len(b) == 0 {
+			t.Errorf("%+v %+v %+v", res.StatusCode, res.Header, len(b))
+		}
+		if e := res.Header.Get("X-HTTP-Thumbnail-Error"); e != "" {
+			t.Errorf("%+v", e)
+		}
+		etag = res.Header.Get("ETag")
+	}
+
+	// once made, HEAD and conditional GET answer from its meta
+	req, _ := http.NewRequest("GET", ts.URL+fmt.Sprintf("/thumbload?id=%s&thumb=icon", att.Id), nil)
+	req.Header.Set("If-None-Match", etag)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified || etag == "" {
+		t.Errorf("%+v %q", res.StatusCode, etag)
+	}
+	if res, err = http.Head(ts.URL + fmt.Sprintf("/thumbload?id=%s&thumb=icon", att.Id)); err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") != etag || res.Header.Get("Content-Length") == "" {
+		t.Errorf("%+v %+v", res.StatusCode, res.Header)
+	}
+
+	made, _ := thumbs.storage.ThumbnailByParentId(att.Id)
+	if len(made) != 1 || made[0].Name != "icon" || made[0].Revision != 1 {
+		t.Fatalf("%+v", made)
+	}
+	if body, _ := m.meta.AttachmentById(made[0].BodyId); body == nil {
+		t.Errorf("%+v", made[0])
+	}
+
+	res, err = http.Get(ts.URL + "/thumbload?thumb=icon&id=missing")
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("%+v", res.StatusCode)
+	}
+
+	if err = thumbnails.DeleteThumbnails(thumbs.storage, att.Id, m.blob, m.meta); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if left, _ := thumbs.storage.ThumbnailByParentId(att.Id); len(left) != 0 {
+		t.Errorf("%+v", left)
+	}
+	if body, _ := m.meta.AttachmentById(made[0].BodyId); body != nil {
+		t.Errorf("%+v", body)
+	}
+}
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/memstore"
+)
+
+func TestMemstoreTrash(t *testing.T) {
+	m := newMemMaker()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/load", tenpu.MakeFileLoader(m))
+	mux.HandleFunc("/delete", tenpu.MakeDeleter(m))
+	mux.HandleFunc("/restore", tenpu.MakeRestorer(m))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(path string) (status int, body string) {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			panic(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res.StatusCode, string(b)
+	}
+
+	var atts []*tenpu.Attachment
+	for _, content := range []string{"kept", "restored", "purged"} {
+		input := &tenpuInput{FileName: content + ".txt", ContentType: "text/plain", OwnerId: "trash"}
+		att, err := tenpu.CreateAttachment(input, m.blob, m.meta, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		atts = append(atts, att)
+	}
+	restored, purged := atts[1], atts[2]
+
+	for _, att := range []*tenpu.Attachment{restored, purged} {
+		if status, body := get("/delete?id=" + att.Id); status != http.StatusOK {
+			t.Errorf("%+v %s", status, body)
+		}
+	}
+	if status, _ := get("/delete?id=" + purged.Id); status != http.StatusNotFound {
+		t.Errorf("deleting twice: %+v", status)
+	}
+	if status, _ := get("/load?id=" + restored.Id); status != http.StatusNotFound {
+		t.Errorf("%+v", status)
+	}
+	if atts, err := m.meta.Attachments("trash"); err != nil || len(atts) != 1 {
+		t.Errorf("%+v", atts)
+	}
+
+	if status, body := get("/restore?id=" + restored.Id); status != http.StatusOK || !strings.Contains(body, restored.Id) {
+		t.Errorf("%+v %s", status, body)
+	}
+	if status, _ := get("/restore?id=" + atts[0].Id); status != http.StatusNotFound {
+		t.Errorf("restoring a live attachment: %+v", status)
+	}
+	if status, body := get("/load?id=" + restored.Id); status != http.StatusOK || body != "restored" {
+		t.Errorf("%+v %s", status, body)
+	}
+
+	var onPurge []string
+	purger := &tenpu.Purger{
+		Blob:      m.blob,
+		Meta:      m.meta,
+		Retention: time.Hour,
+		OnPurge: func(att *tenpu.Attachment) error {
+			onPurge = append(onPurge, att.Id)
+			return nil
+		},
+	}
+	if r, err := purger.Purge(context.Background()); err != nil || len(r) != 0 {
+		t.Errorf("purged before the retention: %+v %+v", r, err)
+	}
+
+	purger.Retention = 0
+	r, err := purger.Purge(context.Background())
+	if err != nil || len(r) != 1 || r[0].Id != purged.Id || len(onPurge) != 1 || onPurge[0] != purged.Id {
+		t.Errorf("%+v %+v %+v", r, onPurge, err)
+	}
+	if att, err := m.meta.AttachmentById(purged.Id); err != nil || att != nil {
+		t.Errorf("%+v", att)
+	}
+	if _, err = m.blob.Open(purged); !errors.Is(err, tenpu.ErrNotFound) {
+		t.Errorf("%+v", err)
+	}
+	if atts, err := m.meta.Attachments("trash"); err != nil || len(atts) != 2 {
+		t.Errorf("%+v", atts)
+	}
+
+	// one attachment that keeps failing does not hold up the others
+	for _, content := range []string{"stuck", "freed"} {
+		att, err := tenpu.CreateAttachment(&tenpuInput{FileName: content + ".txt", OwnerId: "trash"}, m.blob, m.meta, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = tenpu.DeleteAttachment(&tenpuInput{Id: att.Id}, m.blob, m.meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errStuck := errors.New("thumbnails of stuck.txt can not be removed")
+	purger.OnPurge = func(att *tenpu.Attachment) error {
+		if att.Filename == "stuck.txt" {
+			return errStuck
+		}
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		r, err = purger.Purge(context.Background())
+		if !errors.Is(err, errStuck) || len(r) != 1-i || (i == 0 && r[0].Filename != "freed.txt") {
+			t.Errorf("%d: %+v %+v", i, r, err)
+		}
+	}
+}
+
+// restoringTrash restores the attachments it lists, right after listing
+// them, like a user racing the Purger.
+type restoringTrash struct {
+	*memstore.MetaStorage
+}
+
+func (m *restoringTrash) TrashedAttachments(deletedBefore time.Time) (r []*tenpu.Attachment, err error) {
+	if r, err = m.MetaStorage.TrashedAttachments(deletedBefore); err != nil {
+		return
+	}
+	for _, att := range r {
+		if _, err = tenpu.RestoreAttachment(&tenpuInput{Id: att.Id}, m.MetaStorage); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func TestMemstorePurgeRestored(t *testing.T) {
+	m := newMemMaker()
+	att, err := tenpu.CreateAttachment(&tenpuInput{FileName: "back.txt", OwnerId: "trash"}, m.blob, m.meta, strings.NewReader("back"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = tenpu.DeleteAttachment(&tenpuInput{Id: att.Id}, m.blob, m.meta); err != nil {
+		t.Fatal(err)
+	}
+
+	purger := &tenpu.Purger{Blob: m.blob, Meta: &restoringTrash{m.meta}}
+	if r, err := purger.Purge(context.Background()); err != nil || len(r) != 0 {
+		t.Errorf("%+v %+v", r, err)
+	}
+	if stored, err := m.meta.AttachmentById(att.Id); err != nil || stored == nil || stored.Trashed() {
+		t.Errorf("%+v %+v", stored, err)
+	}
+	if _, err = m.blob.Open(att); err != nil {
+		t.Errorf("%+v", err)
+	}
+}
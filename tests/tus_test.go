@@ -0,0 +1,216 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/localfs"
+	"github.com/theplant/tenpu/memstore"
+)
+
+func tusRequest(method string, url string, body string, headers ...string) *http.Response {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res
+}
+
+func testResumableUpload(t *testing.T, store tenpu.UploadStore) {
+	m := newMemMaker()
+	mux := http.NewServeMux()
+	mux.Handle("/files/", tenpu.MakeResumableUploader(m, store, "/files/"))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("filea.txt")) +
+		",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain")) +
+		",OwnerId " + base64.StdEncoding.EncodeToString([]byte("tusowner"))
+
+	res := tusRequest("POST", ts.URL+"/files/", "", "Upload-Length", "19", "Upload-Metadata", metadata)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("%+v", res.Status)
+	}
+	location := ts.URL + res.Header.Get("Location")
+
+	res = tusRequest("PATCH", location, "the file ", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != "9" {
+		t.Fatalf("%+v %+v", res.Status, res.Header)
+	}
+
+	res = tusRequest("HEAD", location, "")
+	if res.Header.Get("Upload-Offset") != "9" || res.Header.Get("Upload-Length") != "19" {
+		t.Errorf("%+v", res.Header)
+	}
+
+	res = tusRequest("PATCH", location, "content a\n", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("%+v", res.Status)
+	}
+
+	res = tusRequest("PATCH", location, "content a\n", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "9")
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("X-Attachment-Id") == "" {
+		t.Fatalf("%+v %+v", res.Status, res.Header)
+	}
+
+	att, _ := m.meta.AttachmentById(res.Header.Get("X-Attachment-Id"))
+	if att == nil || att.Filename != "filea.txt" || att.OwnerId[0] != "tusowner" || att.MD5 != "c07e44c6ec2d81bbe1ca81cced33ad63" {
+		t.Errorf("%+v", att)
+	}
+
+	res = tusRequest("HEAD", location, "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("%+v", res.Status)
+	}
+
+	// refused by the Authorizer, asked on every request
+	ats := httptest.NewServer(tenpu.MakeResumableUploader(&authorizer{m, ownerOnly}, store, "/files/"))
+	defer ats.Close()
+	res = tusRequest("POST", ats.URL+"/files/", "", "Upload-Length", "19", "Upload-Metadata", metadata)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("%+v", res.Status)
+	}
+	res = tusRequest("POST", ats.URL+"/files/", "", "Upload-Length", "19", "Upload-Metadata", metadata, "X-User", "tusowner")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("%+v", res.Status)
+	}
+	authorized := ats.URL + res.Header.Get("Location")
+	for _, method := range []string{"HEAD", "PATCH", "DELETE"} {
+		res = tusRequest(method, authorized, "the file ", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %+v", method, res.Status)
+		}
+	}
+	if res = tusRequest("HEAD", authorized, "", "X-User", "tusowner"); res.StatusCode != http.StatusOK || res.Header.Get("Upload-Offset") != "0" {
+		t.Errorf("%+v %+v", res.Status, res.Header)
+	}
+	if res = tusRequest("DELETE", authorized, "", "X-User", "tusowner"); res.StatusCode != http.StatusNoContent {
+		t.Errorf("%+v", res.Status)
+	}
+
+	// a body past the length is refused, and does not finish the upload
+	res = tusRequest("POST", ts.URL+"/files/", "", "Upload-Length", "9", "Upload-Metadata", metadata)
+	location = ts.URL + res.Header.Get("Location")
+	res = tusRequest("PATCH", location, "the file content a\n", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("%+v", res.Status)
+	}
+	req, _ := http.NewRequest("PATCH", location, io.MultiReader(strings.NewReader("the file content a\n")))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusRequestEntityTooLarge || res.Header.Get("X-Attachment-Id") != "" {
+		t.Errorf("%+v %+v", res, err)
+	}
+
+	// only one finish of an upload gets its data
+	up, _ := store.Upload(strings.TrimPrefix(location, ts.URL+"/files/"))
+	if up == nil || up.Offset != 9 {
+		t.Fatalf("%+v", up)
+	}
+	claimed, err := store.Claim(up.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(claimed); string(b) != "the file " {
+		t.Errorf("%q", b)
+	}
+	claimed.Close()
+	if _, err = store.Claim(up.Id); !errors.Is(err, tenpu.ErrNotFound) {
+		t.Errorf("%+v", err)
+	}
+	res = tusRequest("PATCH", location, "", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "9")
+	if res.StatusCode != http.StatusNotFound || res.Header.Get("X-Attachment-Id") != "" {
+		t.Errorf("%+v %+v", res.Status, res.Header)
+	}
+
+	// termination
+	res = tusRequest("POST", ts.URL+"/files/", "", "Upload-Length", "19", "Upload-Metadata", metadata)
+	location = ts.URL + res.Header.Get("Location")
+	res = tusRequest("DELETE", location, "")
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("%+v", res.Status)
+	}
+	res = tusRequest("HEAD", location, "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("%+v", res.Status)
+	}
+
+	// an empty upload is finished on creation
+	res = tusRequest("POST", ts.URL+"/files/", "", "Upload-Length", "0", "Upload-Metadata", metadata)
+	if res.StatusCode != http.StatusCreated || res.Header.Get("X-Attachment-Id") == "" {
+		t.Fatalf("%+v %+v", res.Status, res.Header)
+	}
+	if att, _ = m.meta.AttachmentById(res.Header.Get("X-Attachment-Id")); att == nil || att.ContentLength != 0 {
+		t.Errorf("%+v", att)
+	}
+	if res = tusRequest("HEAD", ts.URL+res.Header.Get("Location"), ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("%+v", res.Status)
+	}
+
+	// expiration
+	res = tusRequest("POST", ts.URL+"/files/", "", "Upload-Length", "19", "Upload-Metadata", metadata)
+	if res.Header.Get("Upload-Expires") == "" {
+		t.Errorf("%+v", res.Header)
+	}
+	abandoned := ts.URL + res.Header.Get("Location")
+	res = tusRequest("POST", ts.URL+"/files/", "", "Upload-Length", "19", "Upload-Metadata", metadata)
+	gone := ts.URL + res.Header.Get("Location")
+
+	expirer := &tenpu.UploadExpirer{Store: store, Expiry: time.Hour}
+	if expired, err := expirer.Expire(context.Background()); err != nil || len(expired) != 0 {
+		t.Errorf("%+v %+v", expired, err)
+	}
+	defer func(expiry time.Duration) { tenpu.UploadExpiry = expiry }(tenpu.UploadExpiry)
+	tenpu.UploadExpiry = time.Nanosecond
+	if res = tusRequest("HEAD", gone, ""); res.StatusCode != http.StatusGone {
+		t.Errorf("%+v", res.Status)
+	}
+	expirer.Expiry = time.Nanosecond
+	if expired, err := expirer.Expire(context.Background()); err != nil || len(expired) != 1 || !strings.HasSuffix(abandoned, expired[0].Id) {
+		t.Errorf("%+v %+v", expired, err)
+	}
+	if res = tusRequest("HEAD", abandoned, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("%+v", res.Status)
+	}
+
+	// the handler expires uploads like its expirer
+	tenpu.UploadExpiry = time.Hour
+	ets := httptest.NewServer(tenpu.MakeExpiringResumableUploader(m, expirer, "/files/"))
+	defer ets.Close()
+	res = tusRequest("POST", ets.URL+"/files/", "", "Upload-Length", "19", "Upload-Metadata", metadata)
+	if res = tusRequest("HEAD", ets.URL+res.Header.Get("Location"), ""); res.StatusCode != http.StatusGone {
+		t.Errorf("%+v", res.Status)
+	}
+}
+
+func TestResumableUploadMemstore(t *testing.T) {
+	testResumableUpload(t, memstore.NewUploadStore())
+}
+
+func TestResumableUploadLocalfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenpu_uploads")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testResumableUpload(t, localfs.NewUploadStore(dir))
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theplant/tenpu"
+	"github.com/theplant/tenpu/memstore"
+)
+
+// zipInput loads the attachments of OwnerId into a zip.
+type zipInput struct {
+	tenpuInput
+	meta *memstore.MetaStorage
+}
+
+func (d *zipInput) LoadAttachments() (atts []*tenpu.Attachment, err error) {
+	return d.meta.Attachments(d.OwnerId)
+}
+
+type zipBuilderInput struct {
+	zipInput
+	builder *tenpu.ZipBuilder
+}
+
+func (d *zipBuilderInput) GetZipBuilder() (b *tenpu.ZipBuilder) {
+	return d.builder
+}
+
+func zipEntries(body []byte) (names []string, bodies map[string]string) {
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		panic(err)
+	}
+	bodies = make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			panic(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		names = append(names, f.Name)
+		bodies[f.Name] = string(b)
+	}
+	return
+}
+
+func TestMemstoreZip(t *testing.T) {
+	// lays the zips of an owner out by Category
+	m := newMemMaker()
+	m.readInput = func(r *http.Request, d *tenpuInput) tenpu.Input {
+		return &zipBuilderInput{zipInput{*d, m.meta}, &tenpu.ZipBuilder{Layout: tenpu.CategoryLayout}}
+	}
+
+	var atts []*tenpu.Attachment
+	put := func(filename string, category string, body string) {
+		att := &tenpu.Attachment{OwnerId: []string{"o1"}, Category: category}
+		if err := m.blob.Put(filename, "text/plain", strings.NewReader(body), att); err != nil {
+			panic(err)
+		}
+		if err := m.meta.Put(att); err != nil {
+			panic(err)
+		}
+		atts = append(atts, att)
+	}
+	put("a.txt", "docs", "one")
+	put("a.txt", "docs", "two")
+	put("a.txt", "images", "one")
+	put("../../etc/passwd", "..", "root")
+
+	cases := []struct {
+		builder *tenpu.ZipBuilder
+		names   string
+	}{
+		{tenpu.DefaultZipBuilder, "a.txt,a (1).txt,a (2).txt,.._.._etc_passwd"},
+		{&tenpu.ZipBuilder{Naming: tenpu.MD5PrefixedNames}, "a.txt," + atts[1].MD5 + "_a.txt,.._.._etc_passwd"},
+		{&tenpu.ZipBuilder{Layout: tenpu.CategoryLayout}, "docs/a.txt,docs/a (1).txt,images/a.txt,.._.._etc_passwd"},
+		{&tenpu.ZipBuilder{Layout: tenpu.OwnerLayout}, "o1/a.txt,o1/a (1).txt,o1/a (2).txt,o1/.._.._etc_passwd"},
+	}
+	for i, c := range cases {
+		var buf bytes.Buffer
+		// the same attachment twice is zipped once
+		if err := c.builder.Write(context.Background(), m.blob, append(atts, atts[0]), &buf); err != nil {
+			t.Fatal(err)
+		}
+		names, bodies := zipEntries(buf.Bytes())
+		if strings.Join(names, ",") != c.names || bodies[names[1]] != "two" {
+			t.Errorf("%d: %+v", i, names)
+		}
+	}
+	for _, att := range atts[:3] {
+		if att.Filename != "a.txt" {
+			t.Errorf("%+v", att.Filename)
+		}
+	}
+
+	ts := httptest.NewServer(tenpu.MakeZipFileLoader(m))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?OwnerId=o1")
+	if err != nil {
+		panic(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/zip" ||
+		res.Header.Get("Content-Disposition") != `attachment; filename="`+tenpu.ZipFilename+`"` {
+		t.Errorf("%+v %+v", res.StatusCode, res.Header)
+	}
+	if names, bodies := zipEntries(body); len(names) != 4 || bodies["images/a.txt"] != "one" {
+		t.Errorf("%+v", names)
+	}
+}
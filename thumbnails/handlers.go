@@ -13,6 +13,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/sunfmin/resize"
@@ -70,6 +71,9 @@ type Configuration struct {
 	ThumbnailStorageMaker ThumbnailStorageMaker
 	ThumbnailSpecs        []*ThumbnailSpec
 	DefaultThumbnails     []string
+	// Signer, when set, makes MakeLoader only serve requests it signed for
+	// the attachment id and thumbnail name.
+	Signer *tenpu.Signer
 }
 
 func loadFile(fileName string) (buf []byte, err error) {
@@ -116,16 +120,25 @@ func MakeLoader(config *Configuration) http.HandlerFunc {
 		storage, meta, input, err2 := config.Maker.MakeForRead(r)
 		if err2 != nil {
 			log.Printf("tenpu/thumbnails: load attachment storage error %+v\n", err2)
-			http.NotFound(w, r)
+			http.Error(w, err2.Error(), tenpu.StatusCode(err2))
 			return
 		}
 
-		id, thumbName, _ := input.GetViewMeta()
+		id, thumbName, download := input.GetViewMeta()
 		if id == "" || thumbName == "" {
 			http.NotFound(w, r)
 			return
 		}
 
+		revision := tenpu.InputRevision(input)
+		if config.Signer != nil {
+			if err := config.Signer.Verify(r, []string{id}, thumbName, download, revision); err != nil {
+				log.Printf("tenpu/thumbnails: load thumbnail %s of %s refused: %v", thumbName, id, err)
+				http.Error(w, err.Error(), tenpu.StatusCode(err))
+				return
+			}
+		}
+
 		var spec *ThumbnailSpec
 		for _, ts := range config.ThumbnailSpecs {
 			if ts.Name == thumbName {
@@ -142,21 +155,56 @@ func MakeLoader(config *Configuration) http.HandlerFunc {
 
 		thumbnailStorage, err1 := config.ThumbnailStorageMaker.Make(r)
 		if err1 != nil {
-			log.Println("tenpu/thumbnails: load thumbnail storage error %+v", err1)
-			http.NotFound(w, r)
+			log.Printf("tenpu/thumbnails: load thumbnail storage error %+v\n", err1)
+			http.Error(w, err1.Error(), tenpu.StatusCode(err1))
 			return
 		}
 
-		thumb := thumbnailStorage.ThumbnailByName(id, thumbName)
+		att, err := meta.AttachmentById(id)
+		if err != nil {
+			log.Printf("tenpu/thumbnails: load attachment %s error: %v", id, err)
+			http.Error(w, err.Error(), tenpu.StatusCode(err))
+			return
+		}
+		if att == nil || att.Trashed() {
+			http.NotFound(w, r)
+			return
+		}
 
-		if thumb == nil {
-			var att = meta.AttachmentById(id)
-			if att == nil {
+		if revision > 0 {
+			if att = att.AtRevision(revision); att == nil {
 				http.NotFound(w, r)
 				return
 			}
+		}
+
+		action := tenpu.ActionRead
+		if download {
+			action = tenpu.ActionDownload
+		}
+		if err = tenpu.Authorize(config.Maker, r, action, att); err != nil {
+			log.Printf("tenpu/thumbnails: %s thumbnail %s of %s refused: %v", action, thumbName, id, err)
+			http.Error(w, err.Error(), tenpu.StatusCode(err))
+			return
+		}
+
+		thumb, err := thumbnailStorage.ThumbnailByRevision(id, thumbName, att.CurrentRevision())
+		if err != nil {
+			log.Printf("tenpu/thumbnails: load thumbnail %s of %s error: %v", thumbName, id, err)
+			http.Error(w, err.Error(), tenpu.StatusCode(err))
+			return
+		}
 
-			var err error
+		if thumb == nil && r.Method == "HEAD" {
+			// HEAD does not touch blob storage, the thumbnail is made by
+			// the first GET. A conditional GET has nothing to match while
+			// there is no thumbnail, so it makes one like any GET.
+			w.Header().Set("Content-Type", att.ContentType)
+			w.Header().Set("Cache-Control", "no-cache")
+			return
+		}
+
+		if thumb == nil {
 			thumb, err = resizeAndStore(storage, meta, thumbnailStorage, att, spec, thumbName, id)
 			if err != nil {
 				log.Printf("tenpu/thumbnails: %+v", err)
@@ -181,7 +229,12 @@ func MakeLoader(config *Configuration) http.HandlerFunc {
 			}
 		}
 
-		thumbAttachment := meta.AttachmentById(thumb.BodyId)
+		thumbAttachment, err := meta.AttachmentById(thumb.BodyId)
+		if err != nil {
+			log.Printf("tenpu/thumbnails: load body attachment of %+v error: %v", thumb, err)
+			http.Error(w, err.Error(), tenpu.StatusCode(err))
+			return
+		}
 		if thumbAttachment == nil {
 			log.Printf("tenpu/thumbnails: Can't find body attachment by %+v", thumb)
 			http.NotFound(w, r)
@@ -191,11 +244,16 @@ func MakeLoader(config *Configuration) http.HandlerFunc {
 		w.Header().Set("Content-Type", thumbAttachment.ContentType)
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", thumbAttachment.ContentLength))
 		tenpu.SetCacheControl(w, 30)
+		tenpu.SetValidators(w, thumbAttachment)
 
-		err := storage.Copy(thumbAttachment, w)
+		if tenpu.NotModified(w, r) || r.Method == "HEAD" {
+			return
+		}
+
+		err = storage.Copy(thumbAttachment, w)
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), tenpu.StatusCode(err))
 			return
 		}
 
@@ -203,17 +261,17 @@ func MakeLoader(config *Configuration) http.HandlerFunc {
 	}
 }
 
-func resizeAndStore(storage tenpu.BlobStorage, meta tenpu.MetaStorage, thumbnailStorage *Storage, att *tenpu.Attachment, spec *ThumbnailSpec, thumbName string, id string) (thumb *Thumbnail, err error) {
+func resizeAndStore(storage tenpu.BlobStorage, meta tenpu.MetaStorage, thumbnailStorage ThumbnailStorage, att *tenpu.Attachment, spec *ThumbnailSpec, thumbName string, id string) (thumb *Thumbnail, err error) {
 
-	var buf bytes.Buffer
-	storage.Copy(att, &buf)
-
-	if buf.Len() == 0 {
+	f, err := storage.Open(att)
+	if err != nil {
 		return
 	}
+	defer f.Close()
+
 	thumbAtt := &tenpu.Attachment{}
 
-	body, width, height, err := resizeThumbnail(&buf, spec)
+	body, width, height, err := resizeThumbnail(f, spec)
 
 	if err != nil {
 		return
@@ -223,6 +281,7 @@ func resizeAndStore(storage tenpu.BlobStorage, meta tenpu.MetaStorage, thumbnail
 	if err != nil {
 		return
 	}
+	thumbAtt.UploadTime = time.Now()
 
 	err = meta.Put(thumbAtt)
 	if err != nil {
@@ -232,6 +291,7 @@ func resizeAndStore(storage tenpu.BlobStorage, meta tenpu.MetaStorage, thumbnail
 	thumb = &Thumbnail{
 		Name:     thumbName,
 		ParentId: id,
+		Revision: att.CurrentRevision(),
 		BodyId:   thumbAtt.Id,
 		Width:    int64(width),
 		Height:   int64(height),
@@ -240,7 +300,7 @@ func resizeAndStore(storage tenpu.BlobStorage, meta tenpu.MetaStorage, thumbnail
 	return
 }
 
-func resizeThumbnail(from *bytes.Buffer, spec *ThumbnailSpec) (to io.Reader, w int, h int, err error) {
+func resizeThumbnail(from io.Reader, spec *ThumbnailSpec) (to io.Reader, w int, h int, err error) {
 
 	src, name, err := image.Decode(from)
 	if err != nil {
@@ -300,23 +360,33 @@ func MakeDeleter(config *Configuration) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		blob, meta, input, _ := config.Maker.MakeForRead(r)
-
-		att, deleted, err := tenpu.DeleteAttachment(input, blob, meta)
+		blob, meta, input, err := config.Maker.MakeForRead(r)
 		if err != nil {
-			writeJson(w, err.Error(), []*tenpu.Attachment{att})
+			writeJson(w, tenpu.StatusCode(err), err.Error(), nil)
 			return
 		}
 
-		if deleted {
-			thumbnailStorage, _ := config.ThumbnailStorageMaker.Make(r)
-			if err = thumbnailStorage.DeleteThumbnails(att.Id, blob, meta); err != nil {
-				writeJson(w, err.Error(), []*tenpu.Attachment{att})
+		id, _, _ := input.GetViewMeta()
+		if id != "" {
+			var att *tenpu.Attachment
+			if att, err = meta.AttachmentById(id); err == nil && att != nil {
+				err = tenpu.Authorize(config.Maker, r, tenpu.ActionDelete, att)
+			}
+			if err != nil {
+				writeJson(w, tenpu.StatusCode(err), err.Error(), nil)
 				return
 			}
 		}
 
-		writeJson(w, "", []*tenpu.Attachment{att})
+		// the thumbnails stay while the attachment is in the trash, they
+		// go with it when it is purged, see PurgeThumbnails
+		att, _, err := tenpu.DeleteAttachmentContext(r.Context(), input, blob, meta)
+		if err != nil {
+			writeJson(w, tenpu.StatusCode(err), err.Error(), []*tenpu.Attachment{att})
+			return
+		}
+
+		writeJson(w, http.StatusOK, "", []*tenpu.Attachment{att})
 		return
 	}
 }
@@ -326,12 +396,13 @@ type Result struct {
 	Attachments []*tenpu.Attachment
 }
 
-func writeJson(w http.ResponseWriter, err string, attachments []*tenpu.Attachment) {
+func writeJson(w http.ResponseWriter, status int, err string, attachments []*tenpu.Attachment) {
 	r := &Result{
 		Error:       err,
 		Attachments: attachments,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	b, _ := json.Marshal(r)
+	w.WriteHeader(status)
 	w.Write(b)
 }
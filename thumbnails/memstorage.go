@@ -0,0 +1,96 @@
+package thumbnails
+
+import (
+	"sync"
+)
+
+// MemStorage is a ThumbnailStorage in process memory, for tests and for
+// running with memstore where nothing needs to survive a restart. It is
+// safe for concurrent use.
+type MemStorage struct {
+	mutex  sync.RWMutex
+	thumbs []*Thumbnail
+}
+
+func NewMemStorage() (s *MemStorage) {
+	s = &MemStorage{}
+	return
+}
+
+func (s *MemStorage) ThumbnailByName(parentId string, name string) (r *Thumbnail, err error) {
+	r = s.find(func(tb *Thumbnail) bool {
+		return tb.ParentId == parentId && tb.Name == name
+	})
+	return
+}
+
+func (s *MemStorage) ThumbnailByRevision(parentId string, name string, revision int) (r *Thumbnail, err error) {
+	r = s.find(func(tb *Thumbnail) bool {
+		if tb.ParentId != parentId || tb.Name != name {
+			return false
+		}
+		if revision == 1 {
+			return tb.Revision <= 1
+		}
+		return tb.Revision == revision
+	})
+	return
+}
+
+func (s *MemStorage) ThumbnailByParentId(parentId string) (r []*Thumbnail, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, tb := range s.thumbs {
+		if tb.ParentId == parentId {
+			copied := *tb
+			r = append(r, &copied)
+		}
+	}
+	return
+}
+
+func (s *MemStorage) Put(thumb *Thumbnail) (err error) {
+	thumb.MakeId()
+	copied := *thumb
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, tb := range s.thumbs {
+		if tb.Id == thumb.Id {
+			s.thumbs[i] = &copied
+			return
+		}
+	}
+	s.thumbs = append(s.thumbs, &copied)
+	return
+}
+
+func (s *MemStorage) RemoveAll(parentId string) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kept := s.thumbs[:0]
+	for _, tb := range s.thumbs {
+		if tb.ParentId != parentId {
+			kept = append(kept, tb)
+		}
+	}
+	s.thumbs = kept
+	return
+}
+
+func (s *MemStorage) find(match func(tb *Thumbnail) bool) (r *Thumbnail) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, tb := range s.thumbs {
+		if match(tb) {
+			copied := *tb
+			r = &copied
+			return
+		}
+	}
+	return
+}
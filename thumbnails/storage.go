@@ -1,6 +1,7 @@
 package thumbnails
 
 import (
+	"errors"
 	"github.com/theplant/mgodb"
 	"github.com/theplant/tenpu"
 	mgo "gopkg.in/mgo.v2"
@@ -29,14 +30,29 @@ func NewStorage(db *mgodb.Database, collectionName string) (s *Storage) {
 	return
 }
 
+// ThumbnailStorage keeps the records of the thumbnails made for the
+// attachments. Storage keeps them in mongodb, MemStorage in memory.
+type ThumbnailStorage interface {
+	// ThumbnailByName gives nil with no error when the thumbnail is not made yet.
+	ThumbnailByName(parentId string, name string) (r *Thumbnail, err error)
+	// ThumbnailByRevision is ThumbnailByName for one revision of the parent,
+	// thumbnails made before revisions only match revision 1.
+	ThumbnailByRevision(parentId string, name string, revision int) (r *Thumbnail, err error)
+	ThumbnailByParentId(parentId string) (r []*Thumbnail, err error)
+	Put(thumb *Thumbnail) (err error)
+	RemoveAll(parentId string) (err error)
+}
+
 type ThumbnailStorageMaker interface {
-	Make(r *http.Request) (storage *Storage, err error)
+	Make(r *http.Request) (storage ThumbnailStorage, err error)
 }
 
 type Thumbnail struct {
 	Id bson.ObjectId `bson:"_id"`
 	// ParentId : original file's attachment id
 	ParentId string
+	// Revision : the revision of the original file it is made from
+	Revision int
 	// BodyId : thumbnail file's attachment id
 	BodyId string
 	Name   string
@@ -51,16 +67,36 @@ func (tb *Thumbnail) MakeId() interface{} {
 	return tb.Id
 }
 
-func (s *Storage) ThumbnailByName(parentId string, name string) (r *Thumbnail) {
+// ThumbnailByName gives nil with no error when the thumbnail is not made yet.
+func (s *Storage) ThumbnailByName(parentId string, name string) (r *Thumbnail, err error) {
+	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
+		err = c.Find(bson.M{"parentid": parentId, "name": name}).One(&r)
+	})
+	if err == mgo.ErrNotFound {
+		r, err = nil, nil
+	}
+	return
+}
+
+// ThumbnailByRevision is ThumbnailByName for one revision of the parent,
+// thumbnails made before revisions only match revision 1.
+func (s *Storage) ThumbnailByRevision(parentId string, name string, revision int) (r *Thumbnail, err error) {
+	query := bson.M{"parentid": parentId, "name": name, "revision": revision}
+	if revision == 1 {
+		query["revision"] = bson.M{"$in": []interface{}{nil, 0, 1}}
+	}
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		c.Find(bson.M{"parentid": parentId, "name": name}).One(&r)
+		err = c.Find(query).One(&r)
 	})
+	if err == mgo.ErrNotFound {
+		r, err = nil, nil
+	}
 	return
 }
 
-func (s *Storage) ThumbnailByParentId(parentId string) (r []*Thumbnail) {
+func (s *Storage) ThumbnailByParentId(parentId string) (r []*Thumbnail, err error) {
 	s.database.CollectionDo(s.collectionName, func(c *mgo.Collection) {
-		c.Find(bson.M{"parentid": parentId}).All(&r)
+		err = c.Find(bson.M{"parentid": parentId}).All(&r)
 	})
 	return
 }
@@ -77,8 +113,30 @@ func (s *Storage) RemoveAll(parentId string) (err error) {
 	return
 }
 
+// PurgeThumbnails gives a tenpu.Purger OnPurge that deletes the thumbnails
+// of the purged attachments.
+func (s *Storage) PurgeThumbnails(blob tenpu.BlobStorage, meta tenpu.MetaStorage) func(att *tenpu.Attachment) error {
+	return PurgeThumbnails(s, blob, meta)
+}
+
 func (s *Storage) DeleteThumbnails(parentAttId string, blob tenpu.BlobStorage, meta tenpu.MetaStorage) (err error) {
-	thumbs := s.ThumbnailByParentId(parentAttId)
+	return DeleteThumbnails(s, parentAttId, blob, meta)
+}
+
+// PurgeThumbnails is Storage.PurgeThumbnails for any ThumbnailStorage.
+func PurgeThumbnails(s ThumbnailStorage, blob tenpu.BlobStorage, meta tenpu.MetaStorage) func(att *tenpu.Attachment) error {
+	return func(att *tenpu.Attachment) error {
+		return DeleteThumbnails(s, att.Id, blob, meta)
+	}
+}
+
+// DeleteThumbnails removes the thumbnails of parentAttId from s along with
+// their attachments, keeping the blobs other attachments still share.
+func DeleteThumbnails(s ThumbnailStorage, parentAttId string, blob tenpu.BlobStorage, meta tenpu.MetaStorage) (err error) {
+	thumbs, err := s.ThumbnailByParentId(parentAttId)
+	if err != nil {
+		return
+	}
 	// log.Println("Delete thumbnail num:", len(thumbs))
 	var thumbAttIds []string
 	for _, thumb := range thumbs {
@@ -87,11 +145,18 @@ func (s *Storage) DeleteThumbnails(parentAttId string, blob tenpu.BlobStorage, m
 
 	for _, thumbAttId := range thumbAttIds {
 
-		err = blob.Delete(thumbAttId)
-		if err != nil && err != mgo.ErrNotFound {
+		var shared bool
+		if shared, err = tenpu.SharedBlob(meta, thumbAttId); err != nil {
 			return
 		}
 
+		if !shared {
+			err = blob.Delete(thumbAttId)
+			if err != nil && !errors.Is(err, tenpu.ErrNotFound) {
+				return
+			}
+		}
+
 		err = meta.Remove(thumbAttId)
 		if err != nil {
 			return
@@ -0,0 +1,162 @@
+package tenpu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Trash is implemented by MetaStorages that can list the attachments in the
+// trash, it is needed by Purger.
+type Trash interface {
+	// TrashedAttachments gives the attachments moved to the trash before
+	// deletedBefore.
+	TrashedAttachments(deletedBefore time.Time) (r []*Attachment, err error)
+}
+
+// Purger removes for good the attachments that have been in the trash for
+// longer than Retention.
+type Purger struct {
+	Blob      BlobStorage
+	Meta      MetaStorage
+	Retention time.Duration
+	// OnPurge, when set, is called before each attachment is purged, to
+	// remove what else is kept for it, like its thumbnails. An error keeps
+	// the attachment in the trash.
+	OnPurge func(att *Attachment) (err error)
+}
+
+// Purge purges the attachments that are due once. An attachment that
+// fails is skipped and left in the trash for the next Purge, the errors of
+// all of them are returned joined, with the attachments purged. One
+// restored or trashed again since it was listed is left as it is.
+func (p *Purger) Purge(ctx context.Context) (purged []*Attachment, err error) {
+	trash, ok := p.Meta.(Trash)
+	if !ok {
+		err = fmt.Errorf("tenpu: meta storage %T has no trash", p.Meta)
+		return
+	}
+
+	atts, err := trash.TrashedAttachments(time.Now().Add(-p.Retention))
+	if err != nil {
+		return
+	}
+
+	var errs []error
+	for _, att := range atts {
+		if cerr := ctx.Err(); cerr != nil {
+			errs = append(errs, cerr)
+			break
+		}
+		done, perr := p.purge(ctx, att)
+		if perr != nil {
+			errs = append(errs, fmt.Errorf("purge file id:%s: %w", att.Id, perr))
+			continue
+		}
+		if done {
+			purged = append(purged, att)
+		}
+	}
+	err = errors.Join(errs...)
+	return
+}
+
+// purge purges att unless it changed since it was listed. The updates of
+// this process wait for the lock of its id, see updateAttachment.
+func (p *Purger) purge(ctx context.Context, att *Attachment) (done bool, err error) {
+	unlock := lockId(att.Id)
+	defer unlock()
+
+	stored, err := MetaContext(p.Meta).AttachmentByIdContext(ctx, att.Id)
+	if err != nil || stored == nil || !stored.Trashed() || !stored.DeletedAt.Equal(att.DeletedAt) {
+		return
+	}
+	att = stored
+
+	if p.OnPurge != nil {
+		if err = p.OnPurge(att); err != nil {
+			return
+		}
+	}
+	if err = PurgeAttachmentContext(ctx, p.Blob, p.Meta, att); err != nil {
+		return
+	}
+	done = true
+	return
+}
+
+// Run purges right away and then every interval, until ctx is done.
+// Errors are logged and retried on the next round.
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := p.Purge(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("tenpu: purge trash error: %v\n", err)
+		}
+		if len(purged) > 0 {
+			log.Printf("tenpu: purged %d files from the trash\n", len(purged))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func RestoreAttachment(input Input, meta MetaStorage) (att *Attachment, err error) {
+	return RestoreAttachmentContext(context.Background(), input, meta)
+}
+
+// RestoreAttachmentContext takes the attachment of the input back out of the
+// trash.
+func RestoreAttachmentContext(ctx context.Context, input Input, meta MetaStorage) (att *Attachment, err error) {
+	id, _, _ := input.GetViewMeta()
+
+	// the attachment is changed as it is stored, see updateAttachment
+	att, err = updateAttachment(ctx, meta, id, func(att *Attachment) (err error) {
+		if !att.Trashed() {
+			err = fmt.Errorf("%w: attachment id %s in trash", ErrNotFound, id)
+			return
+		}
+		att.DeletedAt = time.Time{}
+		return
+	})
+	if err != nil {
+		return
+	}
+	log.Printf("Restore file id:%s, name:%s", att.Id, att.Filename)
+	return
+}
+
+func MakeRestorer(maker StorageMaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, meta, input, err := maker.MakeForRead(r)
+		if err != nil {
+			writeError(w, err, nil)
+			return
+		}
+
+		id, _, _ := input.GetViewMeta()
+		if err = authorizeId(maker, r, meta, id, ActionDelete); err != nil {
+			writeError(w, err, nil)
+			return
+		}
+
+		att, err := RestoreAttachmentContext(r.Context(), input, meta)
+		if err != nil {
+			writeError(w, err, nil)
+			return
+		}
+
+		writeJson(w, "", []*Attachment{att})
+		return
+	}
+}
@@ -0,0 +1,493 @@
+package tenpu
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TusVersion = "1.0.0"
+
+var ErrUploadOffset = errors.New("tenpu: upload offset does not match")
+
+// UploadExpiry is how long a resumable upload is kept unfinished, from its
+// creation. The handlers refuse expired uploads, an UploadExpirer removes
+// them.
+var UploadExpiry = 24 * time.Hour
+
+// Upload is an unfinished resumable upload.
+type Upload struct {
+	Id     string
+	Length int64
+	Offset int64
+	// Metadata is the decoded Upload-Metadata of the creation request.
+	Metadata  map[string]string
+	CreatedAt time.Time
+}
+
+// UploadStore keeps the received chunks of resumable uploads until they are
+// complete and turned into an Attachment.
+type UploadStore interface {
+	// Create assigns upload.Id and stores it with no data.
+	Create(upload *Upload) (err error)
+	// Upload gives the upload of id with its current Offset, nil if unknown.
+	Upload(id string) (upload *Upload, err error)
+	// Append writes body at offset, which must be the current end of the
+	// upload, otherwise it fails with ErrUploadOffset. It never writes
+	// past upload.Length, and returns the bytes written even on error.
+	Append(id string, offset int64, body io.Reader) (n int64, err error)
+	// Open reads the whole data received for id.
+	Open(id string) (r io.ReadCloser, err error)
+	// Claim takes the upload of id out of the store and reads its data,
+	// closing r drops the data. Only one caller gets an upload, the others
+	// fail with ErrNotFound, so a complete upload is finished once.
+	Claim(id string) (r io.ReadCloser, err error)
+	Remove(id string) (err error)
+}
+
+// UploadLister is implemented by UploadStores that can list their uploads,
+// it is needed by UploadExpirer.
+type UploadLister interface {
+	Uploads() (r []*Upload, err error)
+}
+
+// Expired tells if upload is past expiry, a zero expiry never expires.
+func (upload *Upload) Expired(expiry time.Duration) bool {
+	return expiry > 0 && time.Since(upload.CreatedAt) > expiry
+}
+
+// UploadExpirer removes the uploads abandoned before they were finished,
+// for the tus expiration extension.
+type UploadExpirer struct {
+	Store UploadStore
+	// Expiry is how long an upload is kept, zero is UploadExpiry.
+	Expiry time.Duration
+}
+
+// Expire removes the uploads that are expired once. An upload that fails
+// is skipped, the errors of all of them are returned joined, with the
+// uploads removed.
+func (e *UploadExpirer) Expire(ctx context.Context) (expired []*Upload, err error) {
+	lister, ok := e.Store.(UploadLister)
+	if !ok {
+		err = fmt.Errorf("tenpu: upload store %T can not list its uploads", e.Store)
+		return
+	}
+
+	uploads, err := lister.Uploads()
+	if err != nil {
+		return
+	}
+
+	expiry := e.expiry()
+	var errs []error
+	for _, upload := range uploads {
+		if cerr := ctx.Err(); cerr != nil {
+			errs = append(errs, cerr)
+			break
+		}
+		if !upload.Expired(expiry) {
+			continue
+		}
+		if rerr := e.Store.Remove(upload.Id); rerr != nil {
+			errs = append(errs, fmt.Errorf("remove upload [%s]: %w", upload.Id, rerr))
+			continue
+		}
+		expired = append(expired, upload)
+	}
+	err = errors.Join(errs...)
+	return
+}
+
+func (e *UploadExpirer) expiry() time.Duration {
+	if e.Expiry == 0 {
+		return UploadExpiry
+	}
+	return e.Expiry
+}
+
+// Run expires right away and then every interval, until ctx is done.
+// Errors are logged and retried on the next round.
+func (e *UploadExpirer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := e.Expire(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("tenpu: expire uploads error: %v\n", err)
+		}
+		if len(expired) > 0 {
+			log.Printf("tenpu: expired %d unfinished uploads\n", len(expired))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MakeResumableUploader serves the tus 1.0 resumable upload protocol, with
+// the creation, termination and expiration extensions, under basePath. A
+// finished upload goes through CreateAttachment like with MakeUploader, the
+// id of the new attachment is in the X-Attachment-Id response header. An
+// upload is finished by the request that completes it, the creation one
+// for an Upload-Length of 0.
+//
+// Uploads expire UploadExpiry after their creation, run an UploadExpirer to
+// remove the ones abandoned, and use MakeExpiringResumableUploader when it
+// has an Expiry of its own.
+//
+// UploadInput has no tus hook, so the Upload-Metadata is handed to
+// SetMultipart as multipart parts: one form field per key, and a last file
+// part named from the "filename" and typed from the "filetype" keys. The
+// Authorizer of maker is asked on every request with the same parts, so
+// only who may create the attachment can go on with its upload.
+func MakeResumableUploader(maker StorageMaker, store UploadStore, basePath string) http.HandlerFunc {
+	return MakeExpiringResumableUploader(maker, &UploadExpirer{Store: store}, basePath)
+}
+
+// MakeExpiringResumableUploader is MakeResumableUploader for the uploads
+// of expirer.Store, expiring them after expirer.Expiry.
+func MakeExpiringResumableUploader(maker StorageMaker, expirer *UploadExpirer, basePath string) http.HandlerFunc {
+	store := expirer.Store
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TusVersion)
+		expiry := expirer.expiry()
+
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Tus-Version", TusVersion)
+			w.Header().Set("Tus-Extension", "creation,termination,expiration")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Header.Get("Tus-Resumable") != TusVersion {
+			w.Header().Set("Tus-Version", TusVersion)
+			http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, basePath), "/")
+
+		if r.Method == "POST" && id == "" {
+			createUpload(w, r, maker, store, expiry, basePath)
+			return
+		}
+
+		upload, err := store.Upload(id)
+		if err != nil {
+			log.Printf("tenpu: load upload [%s] error: %v\n", id, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if upload == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if upload.Expired(expiry) {
+			if err = store.Remove(id); err != nil {
+				log.Printf("tenpu: remove expired upload [%s] error: %v\n", id, err)
+			}
+			http.Error(w, "upload expired", http.StatusGone)
+			return
+		}
+		if err = authorizeUpload(r, maker, upload.Metadata); err != nil {
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+
+		switch r.Method {
+		case "HEAD":
+			setUploadExpires(w, upload, expiry)
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+			w.WriteHeader(http.StatusOK)
+		case "PATCH":
+			patchUpload(w, r, maker, store, upload, expiry)
+		case "DELETE":
+			if err = store.Remove(id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request, maker StorageMaker, store UploadStore, expiry time.Duration, basePath string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	// authorize early, so uploads that would be refused are never stored
+	if err = authorizeUpload(r, maker, metadata); err != nil {
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
+
+	upload := &Upload{
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}
+	if err = store.Create(upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// an empty upload is complete already
+	if length == 0 {
+		var att *Attachment
+		if att, err = finishUpload(r, maker, store, upload); err != nil {
+			log.Printf("tenpu: finish upload [%s] error: %v\n", upload.Id, err)
+			if rerr := store.Remove(upload.Id); rerr != nil && !errors.Is(rerr, ErrNotFound) {
+				log.Printf("tenpu: remove upload [%s] error: %v\n", upload.Id, rerr)
+			}
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+		w.Header().Set("X-Attachment-Id", att.Id)
+	} else {
+		setUploadExpires(w, upload, expiry)
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(basePath, "/")+"/"+upload.Id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// setUploadExpires tells the client until when it can finish upload.
+func setUploadExpires(w http.ResponseWriter, upload *Upload, expiry time.Duration) {
+	if expiry > 0 {
+		w.Header().Set("Upload-Expires", upload.CreatedAt.Add(expiry).UTC().Format(http.TimeFormat))
+	}
+}
+
+func patchUpload(w http.ResponseWriter, r *http.Request, maker StorageMaker, store UploadStore, upload *Upload, expiry time.Duration) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		http.Error(w, ErrUploadOffset.Error(), http.StatusConflict)
+		return
+	}
+
+	// a body going past the length is refused, before anything is
+	// written when its length is known
+	left := upload.Length - offset
+	if r.ContentLength > left {
+		http.Error(w, ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	n, err := store.Append(upload.Id, offset, &uploadBody{r: r.Body, left: left})
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if errors.Is(err, ErrUploadOffset) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("tenpu: append upload [%s] error: %v\n", upload.Id, err)
+		http.Error(w, err.Error(), StatusCode(err))
+		return
+	}
+
+	if offset == upload.Length {
+		var att *Attachment
+		att, err = finishUpload(r, maker, store, upload)
+		if err != nil {
+			log.Printf("tenpu: finish upload [%s] error: %v\n", upload.Id, err)
+			http.Error(w, err.Error(), StatusCode(err))
+			return
+		}
+		w.Header().Set("X-Attachment-Id", att.Id)
+	} else {
+		setUploadExpires(w, upload, expiry)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadBody reads the left bytes of a PATCH body, and fails with
+// ErrTooLarge when the body has more. It looks one byte past the end as
+// soon as it gets there, the UploadStore stops reading at the length.
+type uploadBody struct {
+	r    io.Reader
+	left int64
+}
+
+func (b *uploadBody) Read(p []byte) (n int, err error) {
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	if len(p) > 0 {
+		n, err = b.r.Read(p)
+		b.left -= int64(n)
+	}
+	if b.left > 0 || (err != nil && err != io.EOF) {
+		return
+	}
+
+	var more [1]byte
+	if m, _ := io.ReadFull(b.r, more[:]); m > 0 {
+		err = ErrTooLarge
+		return
+	}
+	err = io.EOF
+	if n > 0 {
+		err = nil
+	}
+	return
+}
+
+// finishUpload turns the complete upload into an Attachment. The upload is
+// claimed first, so of concurrent requests finishing it only one creates
+// the attachment, the others fail with ErrNotFound. Once claimed the
+// upload is gone, a failure past that needs a new upload.
+func finishUpload(r *http.Request, maker StorageMaker, store UploadStore, upload *Upload) (att *Attachment, err error) {
+	blob, meta, input, err := maker.MakeForUpload(r)
+	if err != nil {
+		return
+	}
+	if err = setUploadMetadata(input, upload.Metadata); err != nil {
+		return
+	}
+
+	body, err := store.Claim(upload.Id)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	att, err = CreateAttachmentContext(r.Context(), input, blob, meta, body)
+	if err != nil {
+		return
+	}
+	log.Printf("Upload file id:%s, name:%s, size:%.2f M", att.Id, att.Filename, float32(att.ContentLength)/1024/1024)
+	postUpload(maker, r, blob, meta, att)
+	return
+}
+
+// authorizeUpload asks the Authorizer of maker if r may upload the
+// attachment metadata describes. It is asked on creation and again on
+// every request on the upload, its id alone does not give access.
+func authorizeUpload(r *http.Request, maker StorageMaker, metadata map[string]string) (err error) {
+	if _, ok := maker.(Authorizer); !ok {
+		return
+	}
+	_, _, input, err := maker.MakeForUpload(r)
+	if err != nil {
+		return
+	}
+	if err = setUploadMetadata(input, metadata); err != nil {
+		return
+	}
+	err = authorizeCreate(maker, r, input)
+	return
+}
+
+// setUploadMetadata replays metadata to input as the parts of a multipart
+// form, the file part last.
+func setUploadMetadata(input UploadInput, metadata map[string]string) (err error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	var keys []string
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err = mw.WriteField(k, metadata[k]); err != nil {
+			return
+		}
+	}
+
+	filename := firstNonBlank(metadata["filename"], metadata["name"], "file")
+	contentType := firstNonBlank(metadata["filetype"], metadata["type"], "application/octet-stream")
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, quoteEscaper.Replace(filename)))
+	h.Set("Content-Type", contentType)
+	if _, err = mw.CreatePart(h); err != nil {
+		return
+	}
+	if err = mw.Close(); err != nil {
+		return
+	}
+
+	mr := multipart.NewReader(&buf, mw.Boundary())
+	for {
+		var part *multipart.Part
+		part, err = mr.NextPart()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		input.SetMultipart(part)
+	}
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// parseUploadMetadata decodes "key base64value,key2 base64value2".
+func parseUploadMetadata(header string) (metadata map[string]string, err error) {
+	metadata = make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		var v []byte
+		if len(kv) == 2 {
+			v, err = base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return
+			}
+		}
+		metadata[kv[0]] = string(v)
+	}
+	return
+}
+
+func firstNonBlank(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,198 @@
+package tenpu
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ZipLayout gives the folder of the entry of att in a zip, "" for the top.
+type ZipLayout func(att *Attachment) (folder string)
+
+// ZipNaming gives the entry name of att in a zip. p is the path made of
+// its folder and filename, and entries are the ones already in the zip by
+// name. An empty name leaves att out of the zip.
+type ZipNaming func(att *Attachment, p string, entries map[string]*Attachment) (name string)
+
+// ZipBuilderInput is implemented by the Inputs that pick how their zip
+// download is laid out.
+type ZipBuilderInput interface {
+	GetZipBuilder() (b *ZipBuilder)
+}
+
+// ZipBuilder writes attachments as a zip. It never changes the attachments
+// it is given. Entries and archives over 4GB, or of more than 65535 entries,
+// are written with the Zip64 extensions.
+type ZipBuilder struct {
+	// Layout puts the entries in folders, nil is FlatLayout.
+	Layout ZipLayout
+	// Naming tells the entries of the same path apart, nil is
+	// NumberedNames.
+	Naming ZipNaming
+}
+
+// DefaultZipBuilder is the ZipBuilder of WriteZip, and of the handlers when
+// the Input is not a ZipBuilderInput.
+var DefaultZipBuilder = &ZipBuilder{}
+
+// WriteZip writes attachments as a zip with DefaultZipBuilder. It is the
+// Zip of the BlobStorages of tenpu.
+func WriteZip(blob BlobStorage, attachments []*Attachment, w io.Writer) (err error) {
+	return DefaultZipBuilder.Write(context.Background(), blob, attachments, w)
+}
+
+// Write writes the bodies of attachments in blob as a zip to w, each
+// attachment once.
+func (b *ZipBuilder) Write(ctx context.Context, blob BlobStorage, attachments []*Attachment, w io.Writer) (err error) {
+	layout, naming := b.Layout, b.Naming
+	if layout == nil {
+		layout = FlatLayout
+	}
+	if naming == nil {
+		naming = NumberedNames
+	}
+	cblob := BlobContext(blob)
+
+	zw := zip.NewWriter(w)
+	entries := make(map[string]*Attachment)
+	added := make(map[string]bool)
+
+	for _, att := range attachments {
+		if added[att.Id] {
+			continue
+		}
+		added[att.Id] = true
+
+		filename := cleanEntryName(att.Filename)
+		if filename == "" {
+			filename = att.Id
+		}
+		p := filename
+		if folder := cleanEntryName(layout(att)); folder != "" {
+			p = folder + "/" + filename
+		}
+		name := naming(att, p, entries)
+		if name == "" {
+			continue
+		}
+		entries[name] = att
+
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		if compressed(att.ContentType) {
+			header.Method = zip.Store
+		}
+		if !att.UploadTime.IsZero() {
+			header.Modified = att.UploadTime
+		}
+
+		var f io.Writer
+		if f, err = zw.CreateHeader(header); err != nil {
+			return
+		}
+		if err = cblob.CopyContext(ctx, att, f); err != nil {
+			err = fmt.Errorf("zip entry %s of attachment id %s: %w", name, att.Id, err)
+			return
+		}
+	}
+
+	err = zw.Close()
+	return
+}
+
+// FlatLayout puts all entries at the top of the zip.
+func FlatLayout(att *Attachment) (folder string) {
+	return
+}
+
+// CategoryLayout puts the entries in a folder of their Category.
+func CategoryLayout(att *Attachment) (folder string) {
+	return att.Category
+}
+
+// OwnerLayout puts the entries in a folder of their first owner.
+func OwnerLayout(att *Attachment) (folder string) {
+	if len(att.OwnerId) > 0 {
+		folder = att.OwnerId[0]
+	}
+	return
+}
+
+// GroupLayout puts the entries in a folder of their first group.
+func GroupLayout(att *Attachment) (folder string) {
+	if len(att.GroupId) > 0 {
+		folder = att.GroupId[0]
+	}
+	return
+}
+
+// NumberedNames names the entries of a taken path like "name (1).ext",
+// "name (2).ext" and so on.
+func NumberedNames(att *Attachment, p string, entries map[string]*Attachment) (name string) {
+	if _, ok := entries[p]; !ok {
+		return p
+	}
+	ext := path.Ext(p)
+	if ext == path.Base(p) {
+		// a dot file, like ".env", is all name
+		ext = ""
+	}
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, ok := entries[name]; !ok {
+			return
+		}
+	}
+}
+
+// MD5PrefixedNames leaves out the entries of a taken path with the same
+// content, and puts the MD5 of the content before the name of the others.
+// It is how the zips of tenpu were named before ZipBuilder.
+func MD5PrefixedNames(att *Attachment, p string, entries map[string]*Attachment) (name string) {
+	taken, ok := entries[p]
+	if !ok {
+		return p
+	}
+	if att.MD5 != "" && taken.MD5 == att.MD5 {
+		return ""
+	}
+	dir, file := path.Split(p)
+	return NumberedNames(att, dir+att.MD5+"_"+file, entries)
+}
+
+// cleanEntryName makes s one safe path segment: no folders, no "." or
+// "..", so an entry can not be written outside of where the zip is
+// extracted.
+func cleanEntryName(s string) string {
+	s = strings.Map(func(c rune) rune {
+		if c == '/' || c == '\\' || c < ' ' || c == 0x7f {
+			return '_'
+		}
+		return c
+	}, strings.TrimSpace(s))
+	if s == "." || s == ".." {
+		return ""
+	}
+	return s
+}
+
+// compressed tells if the bodies of contentType are compressed already,
+// so deflating them again is a waste.
+func compressed(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return contentType != "image/bmp" && contentType != "image/svg+xml" && !strings.HasPrefix(contentType, "image/tiff")
+	case strings.HasPrefix(contentType, "video/"), strings.HasPrefix(contentType, "audio/"):
+		return true
+	}
+	switch contentType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-7z-compressed",
+		"application/x-rar-compressed", "application/x-bzip2", "application/x-xz":
+		return true
+	}
+	return false
+}